@@ -1,94 +1,561 @@
 package base_client
 
 import (
-	"encoding/hex"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"sync"
+	"time"
 
-	"github.com/wilfreddenton/crypto"
 	"github.com/wilfreddenton/udp-hole-punching/shared"
 )
 
+// SignalInterval is the minimum time between two signals with the same name
+// and state, repeats sent sooner are dropped. A change of state is always
+// sent.
+const SignalInterval = time.Second
+
+type sentSignal struct {
+	active bool
+	at     time.Time
+}
+
+// signalKey identifies the signals that are rate limited together
+type signalKey struct {
+	peerID string
+	name   string
+}
+
 type Client struct {
 	s                  shared.Server
 	self               *shared.Peer
 	log                *log.Logger
 	logFile            *os.File
-	peer               *shared.Peer
 	sConn              shared.Conn
-	pConn              shared.Conn
-	keySent            bool
-	keyReceived        bool
-	mKeySent           *sync.RWMutex
-	mKeyReceived       *sync.RWMutex
-	mPConn             *sync.Mutex
+	sessions           *shared.Sessions
+	rooms              *shared.Rooms
+	inbox              *shared.Inbox
+	dialed             map[string]bool
+	rekeyPolicy        shared.RekeyPolicy
+	keepalivePolicy    shared.KeepalivePolicy
+	punchStrategy      shared.PunchStrategy
+	ctx                context.Context
+	cancel             context.CancelFunc
+	stop               *sync.Once
+	verified           *shared.VerifiedPeers
+	signals            map[signalKey]sentSignal
+	transfers          *shared.Transfers
+	mDialed            *sync.Mutex
+	mSelf              *sync.RWMutex
+	mSignals           *sync.Mutex
+	mCtx               *sync.RWMutex
 	resetCallback      func(shared.Client)
 	registeredCallback func(shared.Client)
-	connectingCallback func(shared.Client)
-	connectedCallback  func(shared.Client)
-	messageCallback    func(shared.Client, string)
+	connectingCallback func(shared.Client, *shared.Session)
+	connectedCallback  func(shared.Client, *shared.Session)
+	disconnectCallback func(shared.Client, *shared.Session, string)
+	messageCallback    func(shared.Client, *shared.Session, *shared.Chat)
+	receiptCallback    func(shared.Client, *shared.Session, *shared.Receipt)
+	peerSignalCallback func(shared.Client, *shared.Session, *shared.Signal)
+	offerCallback      func(shared.Client, *shared.Session, *shared.Transfer)
+	progressCallback   func(shared.Client, *shared.Session, *shared.Transfer)
+	roomCallback       func(shared.Client, *shared.Room)
+	roomMessage        func(shared.Client, *shared.Room, *shared.Peer, *shared.Chat)
+	mailCallback       func(shared.Client, *shared.Peer, *shared.Chat, time.Time)
+	errorCallback      func(shared.Client, *shared.Error)
+	punchCallback      func(shared.Client, *shared.Session, *shared.PunchResult)
 }
 
-func (c *Client) WasKeySent() bool {
-	c.mKeySent.RLock()
-	defer c.mKeySent.RUnlock()
-	return c.keySent
+func (c *Client) GetLog() *log.Logger {
+	return c.log
 }
 
-func (c *Client) WasKeyReceived() bool {
-	c.mKeyReceived.RLock()
-	defer c.mKeyReceived.RUnlock()
-	return c.keyReceived
+func (c *Client) GetSelf() *shared.Peer {
+	return c.self
 }
 
-func (c *Client) SetKeySent(b bool) {
-	c.mKeySent.Lock()
-	defer c.mKeySent.Unlock()
-	c.keySent = b
+func (c *Client) GetServerConn() shared.Conn {
+	return c.sConn
 }
 
-func (c *Client) SetKeyReceived(b bool) {
-	c.mKeyReceived.Lock()
-	defer c.mKeyReceived.Unlock()
-	c.keyReceived = b
+func (c *Client) SetServerConn(conn shared.Conn) {
+	c.sConn = conn
 }
 
-func (c *Client) GetLog() *log.Logger {
-	return c.log
+func (c *Client) GetSessions() *shared.Sessions {
+	return c.sessions
 }
 
-func (c *Client) GetSelf() *shared.Peer {
-	return c.self
+// GetEndpoint returns the public endpoint the rendezvous server last saw the
+// client at
+func (c *Client) GetEndpoint() shared.Endpoint {
+	c.mSelf.RLock()
+	defer c.mSelf.RUnlock()
+	return c.self.Endpoint
 }
 
-func (c *Client) GetPeer() *shared.Peer {
-	return c.peer
+func (c *Client) SetEndpoint(e shared.Endpoint) {
+	c.mSelf.Lock()
+	defer c.mSelf.Unlock()
+	c.self.Endpoint = e
 }
 
-func (c *Client) SetPeer(p *shared.Peer) {
-	c.peer = p
+func (c *Client) GetRekeyPolicy() shared.RekeyPolicy {
+	return c.rekeyPolicy
 }
 
-func (c *Client) GetServerConn() shared.Conn {
-	return c.sConn
+// SetRekeyPolicy sets when the keys of new peer sessions are rotated
+func (c *Client) SetRekeyPolicy(p shared.RekeyPolicy) {
+	c.rekeyPolicy = p
 }
 
-func (c *Client) SetServerConn(conn shared.Conn) {
-	c.sConn = conn
+func (c *Client) GetKeepalivePolicy() shared.KeepalivePolicy {
+	return c.keepalivePolicy
+}
+
+// SetKeepalivePolicy sets how the liveness of new peer sessions is checked
+func (c *Client) SetKeepalivePolicy(p shared.KeepalivePolicy) {
+	c.keepalivePolicy = p
+}
+
+func (c *Client) GetPunchStrategy() shared.PunchStrategy {
+	return c.punchStrategy
+}
+
+// SetPunchStrategy sets how the client punches through to new peers
+func (c *Client) SetPunchStrategy(p shared.PunchStrategy) {
+	c.punchStrategy = p
+}
+
+// Context returns the context the client runs in, it is done once the
+// client has stopped
+func (c *Client) Context() context.Context {
+	c.mCtx.RLock()
+	defer c.mCtx.RUnlock()
+	return c.ctx
+}
+
+// SetContext runs the client within ctx, the client stops when ctx is done
+func (c *Client) SetContext(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	c.mCtx.Lock()
+	c.ctx, c.cancel = ctx, cancel
+	c.mCtx.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		c.Stop()
+	}()
+}
+
+func (c *Client) GetVerifiedPeers() *shared.VerifiedPeers {
+	return c.verified
+}
+
+// Establish asks the rendezvous server to introduce the client to the peer
+// with the given ID. The session it leads to is marked as dialed.
+func (c *Client) Establish(id string) error {
+	if id == "" {
+		return errors.New("peer ID must not be empty")
+	}
+	if id == c.self.ID {
+		return errors.New("cannot connect to yourself")
+	}
+	if _, ok := c.sessions.Get(id); ok {
+		return errors.New("already in a session with this peer")
+	}
+
+	c.mDialed.Lock()
+	c.dialed[id] = true
+	c.mDialed.Unlock()
+
+	return c.sConn.Send(&shared.Message{
+		Type:    "establish",
+		PeerID:  c.self.ID,
+		Content: id,
+		Encrypt: true,
+	})
+}
+
+// Dialed reports whether the client asked to be introduced to the peer with
+// the given ID and forgets that it did
+func (c *Client) Dialed(id string) bool {
+	c.mDialed.Lock()
+	defer c.mDialed.Unlock()
+	ok := c.dialed[id]
+	delete(c.dialed, id)
+	return ok
+}
+
+// session returns the session with the peer
+func (c *Client) session(peerID string) (*shared.Session, error) {
+	s, ok := c.sessions.Get(peerID)
+	if !ok {
+		return nil, errors.New("not connected to this peer")
+	}
+	return s, nil
+}
+
+// Disconnect tells the peer the session is over and ends it
+func (c *Client) Disconnect(peerID, reason string) error {
+	s, err := c.session(peerID)
+	if err != nil {
+		return err
+	}
+
+	err = s.GetConn().Send(&shared.Message{
+		Type:    "disconnect",
+		PeerID:  c.self.ID,
+		Content: &shared.Disconnect{Reason: reason},
+		Encrypt: true,
+	})
+	c.EndSession(s)
+	return err
+}
+
+// EndSession forgets the session. It returns false when the session had
+// already ended, so that only one caller reports its end.
+func (c *Client) EndSession(s *shared.Session) bool {
+	if !c.sessions.Remove(s) {
+		return false
+	}
+	s.GetConn().GetMux().Close()
+	s.GetConn().GetReliable().Close()
+	return true
+}
+
+// SendMessage sends a line of text to the peer. The returned Chat carries the
+// ID that receipts for the message will refer to.
+func (c *Client) SendMessage(peerID, text string) (*shared.Chat, error) {
+	s, err := c.session(peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	chat := &shared.Chat{ID: shared.GenMessageID(), Text: text}
+	return chat, s.GetConn().Send(&shared.Message{
+		Type:     "message",
+		PeerID:   c.self.ID,
+		Content:  chat,
+		Encrypt:  true,
+		Reliable: true,
+	})
+}
+
+// MarkRead tells the peer that its message with the ID was displayed
+func (c *Client) MarkRead(peerID, id string) error {
+	s, err := c.session(peerID)
+	if err != nil {
+		return err
+	}
+
+	return s.GetConn().Send(&shared.Message{
+		Type:     "receipt",
+		PeerID:   c.self.ID,
+		Content:  shared.Receipt{ID: id, State: shared.Read},
+		Encrypt:  true,
+		Reliable: true,
+	})
+}
+
+// SendSignal sends ephemeral state such as shared.TypingSignal to the peer.
+// Signals are not retransmitted and repeats are rate limited, callers should
+// resend an active signal while it holds so the peer does not time it out.
+func (c *Client) SendSignal(peerID, name string, active bool) error {
+	s, err := c.session(peerID)
+	if err != nil {
+		return err
+	}
+
+	k := signalKey{peerID: peerID, name: name}
+	c.mSignals.Lock()
+	last, ok := c.signals[k]
+	if ok && last.active == active && time.Since(last.at) < SignalInterval {
+		c.mSignals.Unlock()
+		return nil
+	}
+	c.signals[k] = sentSignal{active: active, at: time.Now()}
+	c.mSignals.Unlock()
+
+	return s.GetConn().Send(&shared.Message{
+		Type:    "signal",
+		PeerID:  c.self.ID,
+		Content: shared.Signal{Name: name, Active: active},
+		Encrypt: true,
+	})
+}
+
+func (c *Client) GetTransfers() *shared.Transfers {
+	return c.transfers
+}
+
+// SendFile offers the file at path to the peer, it is sent once the peer
+// accepts it. Sending a file that was interrupted resumes it.
+func (c *Client) SendFile(peerID, path string) (*shared.Transfer, error) {
+	s, err := c.session(peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	t, o, err := c.transfers.Offer(path, peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	return t, s.GetConn().Send(&shared.Message{
+		Type:     "offer",
+		PeerID:   c.self.ID,
+		Content:  o,
+		Encrypt:  true,
+		Reliable: true,
+	})
 }
 
-func (c *Client) GetPeerConn() shared.Conn {
-	c.mPConn.Lock()
-	defer c.mPConn.Unlock()
-	return c.pConn
+// AcceptFile asks the peer that offered the file with the ID to send it. Its
+// progress is reported to the file progress callback as chunks are written.
+func (c *Client) AcceptFile(peerID, id string) error {
+	s, err := c.session(peerID)
+	if err != nil {
+		return err
+	}
+
+	a, ack, err := c.transfers.Accept(peerID, id)
+	if err != nil {
+		return err
+	}
+
+	err = s.GetConn().Send(&shared.Message{
+		Type:     "accept",
+		PeerID:   c.self.ID,
+		Content:  a,
+		Encrypt:  true,
+		Reliable: true,
+	})
+	if err != nil || ack == nil {
+		return err
+	}
+
+	// nothing is left to send so the transfer is already over
+	return s.GetConn().Send(&shared.Message{
+		Type:     "file-ack",
+		PeerID:   c.self.ID,
+		Content:  ack,
+		Encrypt:  true,
+		Reliable: true,
+	})
 }
 
-func (c *Client) SetPeerConn(conn shared.Conn) {
-	c.mPConn.Lock()
-	defer c.mPConn.Unlock()
-	c.pConn = conn
+// ResumeTransfers offers the files that were not completely sent to the peer
+// again
+func (c *Client) ResumeTransfers(peerID string) {
+	for _, t := range c.transfers.Pending(peerID) {
+		_, err := c.SendFile(peerID, t.Path())
+		if err != nil {
+			c.log.Printf("could not resume sending %s: %s", t.Name, err)
+		}
+	}
+}
+
+// OpenStream opens a stream to the peer over its session, name tells the
+// peer what the stream is for
+func (c *Client) OpenStream(peerID, name string) (*shared.Stream, error) {
+	s, err := c.session(peerID)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetConn().GetMux().Open(name)
+}
+
+// AcceptStream waits for the peer to open a stream
+func (c *Client) AcceptStream(peerID string) (*shared.Stream, error) {
+	s, err := c.session(peerID)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetConn().GetMux().Accept()
+}
+
+// addrs returns the addresses of both ends of a session
+func (c *Client) addrs(s *shared.Session) (net.Addr, net.Addr) {
+	local := &shared.PeerAddr{ID: c.self.ID}
+	remote := &shared.PeerAddr{ID: s.GetPeer().ID, Addr: s.GetConn().GetAddr()}
+	return local, remote
+}
+
+// establishedSession returns the session with the peer once its keys are
+// installed
+func (c *Client) establishedSession(peerID string) (*shared.Session, error) {
+	s, err := c.session(peerID)
+	if err != nil {
+		return nil, err
+	}
+	if !s.Established() {
+		return nil, errors.New("the peer session has not been established")
+	}
+	return s, nil
+}
+
+// Dial opens a reliable stream to the peer as a net.Conn, name tells the
+// peer what the stream is for
+func (c *Client) Dial(peerID, name string) (net.Conn, error) {
+	s, err := c.establishedSession(peerID)
+	if err != nil {
+		return nil, err
+	}
+	st, err := s.GetConn().GetMux().Open(name)
+	if err != nil {
+		return nil, err
+	}
+	local, remote := c.addrs(s)
+	return shared.NewStreamConn(st, local, remote), nil
+}
+
+// Listen accepts the streams the peer opens as net.Conns
+func (c *Client) Listen(peerID string) (net.Listener, error) {
+	s, err := c.establishedSession(peerID)
+	if err != nil {
+		return nil, err
+	}
+	local, remote := c.addrs(s)
+	return shared.NewStreamListener(s.GetConn().GetMux(), local, remote), nil
+}
+
+// ListenPacket exchanges unreliable datagrams with the peer as a
+// net.PacketConn
+func (c *Client) ListenPacket(peerID string) (net.PacketConn, error) {
+	s, err := c.establishedSession(peerID)
+	if err != nil {
+		return nil, err
+	}
+	local, remote := c.addrs(s)
+	return shared.NewPacketConn(s.GetConn().GetMux(), local, remote), nil
+}
+
+func (c *Client) GetInbox() *shared.Inbox {
+	return c.inbox
+}
+
+// SendMail leaves a line of text for a peer that is offline on the
+// rendezvous server. The peer's public key has to be known, either from an
+// earlier session with it or from verifying it.
+func (c *Client) SendMail(peerID, text string) (*shared.Chat, error) {
+	to, err := c.knownPeer(peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	mail, chat, err := shared.SealMail(c.self, to, text)
+	if err != nil {
+		return nil, err
+	}
+	return chat, c.sConn.Send(&shared.Message{
+		Type:    "mail",
+		PeerID:  c.self.ID,
+		Content: mail,
+		Encrypt: true,
+	})
+}
+
+// knownPeer returns the peer with its public key
+func (c *Client) knownPeer(peerID string) (*shared.Peer, error) {
+	if p, ok := c.sessions.Known(peerID); ok && p.PublicKey != "" {
+		return p, nil
+	}
+	if v, ok := c.verified.Get(peerID); ok && v.PublicKey != "" {
+		return &shared.Peer{ID: v.ID, Username: v.Username, PublicKey: v.PublicKey}, nil
+	}
+	return nil, errors.New("the public key of this peer is not known, connect to it or verify it first")
+}
+
+func (c *Client) GetRooms() *shared.Rooms {
+	return c.rooms
+}
+
+// CreateRoom asks the rendezvous server for a new room with the client as
+// its only member
+func (c *Client) CreateRoom() error {
+	return c.sConn.Send(&shared.Message{
+		Type:    "create-room",
+		PeerID:  c.self.ID,
+		Encrypt: true,
+	})
+}
+
+// JoinRoom asks the rendezvous server to add the client to the room, which
+// introduces it to every other member
+func (c *Client) JoinRoom(id string) error {
+	return c.roomRequest("join-room", id)
+}
+
+// LeaveRoom asks the rendezvous server to take the client out of the room
+func (c *Client) LeaveRoom(id string) error {
+	return c.roomRequest("leave-room", id)
+}
+
+// RefreshRoom asks the rendezvous server for the member list of the room
+func (c *Client) RefreshRoom(id string) error {
+	return c.roomRequest("room", id)
+}
+
+func (c *Client) roomRequest(t, id string) error {
+	if id == "" {
+		return errors.New("room ID must not be empty")
+	}
+	return c.sConn.Send(&shared.Message{
+		Type:    t,
+		PeerID:  c.self.ID,
+		Content: id,
+		Encrypt: true,
+	})
+}
+
+// SendRoomMessage sends a line of text to every member of the room
+func (c *Client) SendRoomMessage(roomID, text string) (*shared.Chat, error) {
+	r, ok := c.rooms.Get(roomID)
+	if !ok {
+		return nil, errors.New("not a member of this room")
+	}
+
+	env, chat, err := r.Seal(text)
+	if err != nil {
+		return nil, err
+	}
+	return chat, r.FanOut(c.sessions, env, "")
+}
+
+// ShareRoomKeys sends the peer the group keys of the rooms the client keeps
+// and the peer is a member of
+func (c *Client) ShareRoomKeys(peerID string) {
+	s, ok := c.sessions.Get(peerID)
+	if !ok || !s.Established() {
+		return
+	}
+
+	for _, r := range c.rooms.List() {
+		if r.Keeper() != c.self.ID {
+			continue
+		}
+		if _, ok := r.Member(peerID); !ok {
+			continue
+		}
+		k, ok := r.Key()
+		if !ok {
+			continue
+		}
+		err := s.GetConn().Send(&shared.Message{
+			Type:     "room-key",
+			PeerID:   c.self.ID,
+			Content:  k,
+			Encrypt:  true,
+			Reliable: true,
+		})
+		if err != nil {
+			c.log.Print(err)
+		}
+	}
 }
 
 func (c *Client) GetServer() shared.Server {
@@ -99,16 +566,56 @@ func (c *Client) RegisteredCallback(client shared.Client) {
 	c.registeredCallback(client)
 }
 
-func (c *Client) ConnectingCallback(client shared.Client) {
-	c.connectingCallback(client)
+func (c *Client) ConnectingCallback(client shared.Client, s *shared.Session) {
+	c.connectingCallback(client, s)
+}
+
+func (c *Client) ConnectedCallback(client shared.Client, s *shared.Session) {
+	c.connectedCallback(client, s)
 }
 
-func (c *Client) ConnectedCallback(client shared.Client) {
-	c.connectedCallback(client)
+func (c *Client) DisconnectedCallback(client shared.Client, s *shared.Session, reason string) {
+	c.disconnectCallback(client, s, reason)
 }
 
-func (c *Client) MessageCallback(client shared.Client, text string) {
-	c.messageCallback(client, text)
+func (c *Client) MessageCallback(client shared.Client, s *shared.Session, chat *shared.Chat) {
+	c.messageCallback(client, s, chat)
+}
+
+func (c *Client) ReceiptCallback(client shared.Client, s *shared.Session, r *shared.Receipt) {
+	c.receiptCallback(client, s, r)
+}
+
+func (c *Client) PeerSignalCallback(client shared.Client, s *shared.Session, sig *shared.Signal) {
+	c.peerSignalCallback(client, s, sig)
+}
+
+func (c *Client) FileOfferCallback(client shared.Client, s *shared.Session, t *shared.Transfer) {
+	c.offerCallback(client, s, t)
+}
+
+func (c *Client) FileProgressCallback(client shared.Client, s *shared.Session, t *shared.Transfer) {
+	c.progressCallback(client, s, t)
+}
+
+func (c *Client) RoomCallback(client shared.Client, r *shared.Room) {
+	c.roomCallback(client, r)
+}
+
+func (c *Client) RoomMessageCallback(client shared.Client, r *shared.Room, p *shared.Peer, chat *shared.Chat) {
+	c.roomMessage(client, r, p, chat)
+}
+
+func (c *Client) MailCallback(client shared.Client, p *shared.Peer, chat *shared.Chat, sentAt time.Time) {
+	c.mailCallback(client, p, chat, sentAt)
+}
+
+func (c *Client) ErrorCallback(client shared.Client, e *shared.Error) {
+	c.errorCallback(client, e)
+}
+
+func (c *Client) PunchCallback(client shared.Client, s *shared.Session, r *shared.PunchResult) {
+	c.punchCallback(client, s, r)
 }
 
 func (c *Client) OnReset(f func(shared.Client)) {
@@ -119,38 +626,109 @@ func (c *Client) OnRegistered(f func(shared.Client)) {
 	c.registeredCallback = f
 }
 
-func (c *Client) OnConnecting(f func(shared.Client)) {
+func (c *Client) OnConnecting(f func(shared.Client, *shared.Session)) {
 	c.connectingCallback = f
 }
 
-func (c *Client) OnConnected(f func(shared.Client)) {
+func (c *Client) OnConnected(f func(shared.Client, *shared.Session)) {
 	c.connectedCallback = f
 }
 
-func (c *Client) OnMessage(f func(shared.Client, string)) {
+func (c *Client) OnDisconnected(f func(shared.Client, *shared.Session, string)) {
+	c.disconnectCallback = f
+}
+
+func (c *Client) OnMessage(f func(shared.Client, *shared.Session, *shared.Chat)) {
 	c.messageCallback = f
 }
 
+func (c *Client) OnReceipt(f func(shared.Client, *shared.Session, *shared.Receipt)) {
+	c.receiptCallback = f
+}
+
+func (c *Client) OnPeerSignal(f func(shared.Client, *shared.Session, *shared.Signal)) {
+	c.peerSignalCallback = f
+}
+
+func (c *Client) OnFileOffer(f func(shared.Client, *shared.Session, *shared.Transfer)) {
+	c.offerCallback = f
+}
+
+func (c *Client) OnFileProgress(f func(shared.Client, *shared.Session, *shared.Transfer)) {
+	c.progressCallback = f
+}
+
+func (c *Client) OnRoom(f func(shared.Client, *shared.Room)) {
+	c.roomCallback = f
+}
+
+func (c *Client) OnRoomMessage(f func(shared.Client, *shared.Room, *shared.Peer, *shared.Chat)) {
+	c.roomMessage = f
+}
+
+func (c *Client) OnMail(f func(shared.Client, *shared.Peer, *shared.Chat, time.Time)) {
+	c.mailCallback = f
+}
+
+// OnError sets the function errors are reported to. Without one errors are
+// logged and fatal errors end the process.
+func (c *Client) OnError(f func(shared.Client, *shared.Error)) {
+	c.errorCallback = f
+}
+
+func (c *Client) OnPunch(f func(shared.Client, *shared.Session, *shared.PunchResult)) {
+	c.punchCallback = f
+}
+
+// Stop leaves the rooms and sessions of the client, cancels its context and
+// stops its server. Only the first call does anything.
 func (c *Client) Stop() {
-	c.s.Stop()
+	c.stop.Do(func() {
+		for _, r := range c.rooms.List() {
+			c.LeaveRoom(r.GetID())
+		}
+		for _, s := range c.sessions.List() {
+			c.Disconnect(s.GetPeer().ID, "peer exited")
+		}
+
+		c.mCtx.RLock()
+		c.cancel()
+		c.mCtx.RUnlock()
+		c.s.Stop()
+	})
 }
 
-func New(username string, s shared.Server) (*Client, error) {
+// logError is the error callback of clients that did not set one
+func logError(client shared.Client, e *shared.Error) {
+	if e.Kind == shared.FatalError {
+		client.GetLog().Fatalf("%s error handling %s message: %s", e.Kind, e.Type, e)
+	}
+	client.GetLog().Printf("%s error handling %s message: %s", e.Kind, e.Type, e)
+}
+
+// New creates a client for username. Its keys are loaded from store when the
+// key file exists, otherwise a fresh key pair is generated for this run.
+func New(username string, store *shared.IdentityStore, s shared.Server) (*Client, error) {
 	// create peer to store self information
 	self := &shared.Peer{Username: username}
 
-	// create public and private keys
+	// load or create public and private keys
 	var err error
-	var pubKey [32]byte
-	self.PrivateKey, pubKey, err = crypto.GenKeyPair()
+	var kp *shared.KeyPair
+	if store != nil && store.Exists() {
+		kp, err = store.Load()
+	} else {
+		kp, err = shared.GenKeyPair()
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	self.SetPublicKey(pubKey)
+	self.PrivateKey = kp.Private
+	self.SetPublicKey(kp.Public)
 
 	// create client ID: SHA-2 + HMAC hash of public key
-	self.ID = hex.EncodeToString(crypto.Hash("hashing client public key for client id", pubKey[:]))
+	self.ID = shared.GenID(kp.Public)
 
 	// create logger
 	wd, err := os.Getwd()
@@ -166,22 +744,51 @@ func New(username string, s shared.Server) (*Client, error) {
 	l := log.New(lf, "", log.LstdFlags|log.Lshortfile)
 	l.Printf("Logging initialized")
 
-	// create peers
-	p := &shared.Peer{}
+	// load the peers the user has verified in previous sessions
+	v, err := shared.NewVerifiedPeers(fmt.Sprintf("%s/verified-%s.json", wd, self.Username))
+	if err != nil {
+		return nil, err
+	}
+
+	// the context is replaced by the one the client is started with
+	ctx, cancel := context.WithCancel(context.Background())
 
 	return &Client{
 		s:                  s,
 		self:               self,
-		peer:               p,
 		log:                l,
 		logFile:            lf,
-		mKeyReceived:       &sync.RWMutex{},
-		mKeySent:           &sync.RWMutex{},
-		mPConn:             &sync.Mutex{},
+		verified:           v,
+		sessions:           shared.NewSessions(),
+		rooms:              shared.NewRooms(),
+		inbox:              shared.NewInbox(),
+		dialed:             make(map[string]bool),
+		signals:            make(map[signalKey]sentSignal),
+		transfers:          shared.NewTransfers(fmt.Sprintf("%s/downloads-%s", wd, self.Username), self.ID),
+		rekeyPolicy:        shared.DefaultRekeyPolicy,
+		keepalivePolicy:    shared.DefaultKeepalivePolicy,
+		punchStrategy:      shared.DefaultPunchStrategy,
+		ctx:                ctx,
+		cancel:             cancel,
+		stop:               &sync.Once{},
+		mDialed:            &sync.Mutex{},
+		mSelf:              &sync.RWMutex{},
+		mSignals:           &sync.Mutex{},
+		mCtx:               &sync.RWMutex{},
 		resetCallback:      func(shared.Client) {},
 		registeredCallback: func(shared.Client) {},
-		connectingCallback: func(shared.Client) {},
-		connectedCallback:  func(shared.Client) {},
-		messageCallback:    func(shared.Client, string) {},
+		connectingCallback: func(shared.Client, *shared.Session) {},
+		connectedCallback:  func(shared.Client, *shared.Session) {},
+		disconnectCallback: func(shared.Client, *shared.Session, string) {},
+		messageCallback:    func(shared.Client, *shared.Session, *shared.Chat) {},
+		receiptCallback:    func(shared.Client, *shared.Session, *shared.Receipt) {},
+		peerSignalCallback: func(shared.Client, *shared.Session, *shared.Signal) {},
+		offerCallback:      func(shared.Client, *shared.Session, *shared.Transfer) {},
+		progressCallback:   func(shared.Client, *shared.Session, *shared.Transfer) {},
+		roomCallback:       func(shared.Client, *shared.Room) {},
+		roomMessage:        func(shared.Client, *shared.Room, *shared.Peer, *shared.Chat) {},
+		mailCallback:       func(shared.Client, *shared.Peer, *shared.Chat, time.Time) {},
+		errorCallback:      logError,
+		punchCallback:      func(shared.Client, *shared.Session, *shared.PunchResult) {},
 	}, nil
 }
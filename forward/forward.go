@@ -0,0 +1,174 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wilfreddenton/udp-hole-punching/shared"
+)
+
+// streams opened for forwarding are named with this prefix and the target
+const forwardPrefix = "forward:"
+
+const dialTimeout = 10 * time.Second
+
+// forward is a local port whose connections are forwarded to target through
+// the peer
+type forward struct {
+	listen string
+	target string
+}
+
+// parseForward parses [bind:]port:host:hostport like ssh -L
+func parseForward(spec string) (*forward, error) {
+	parts := strings.Split(spec, ":")
+	switch len(parts) {
+	case 3:
+		return &forward{
+			listen: "127.0.0.1:" + parts[0],
+			target: net.JoinHostPort(parts[1], parts[2]),
+		}, nil
+	case 4:
+		return &forward{
+			listen: net.JoinHostPort(parts[0], parts[1]),
+			target: net.JoinHostPort(parts[2], parts[3]),
+		}, nil
+	}
+	return nil, &net.AddrError{Err: "expected [bind:]port:host:hostport", Addr: spec}
+}
+
+// allowlist is the set of host:port targets the peer may connect to
+type allowlist map[string]bool
+
+func (a allowlist) String() string {
+	var targets []string
+	for t := range a {
+		targets = append(targets, t)
+	}
+	return strings.Join(targets, ",")
+}
+
+func (a allowlist) Set(v string) error {
+	for _, t := range strings.Split(v, ",") {
+		host, port, err := net.SplitHostPort(strings.TrimSpace(t))
+		if err != nil {
+			return err
+		}
+		a[net.JoinHostPort(host, port)] = true
+	}
+	return nil
+}
+
+type forwards []*forward
+
+func (fs *forwards) String() string {
+	var specs []string
+	for _, f := range *fs {
+		specs = append(specs, f.listen+"->"+f.target)
+	}
+	return strings.Join(specs, ",")
+}
+
+func (fs *forwards) Set(v string) error {
+	f, err := parseForward(v)
+	if err != nil {
+		return err
+	}
+	*fs = append(*fs, f)
+	return nil
+}
+
+// serveForward listens on the local port and sends every connection to the
+// peer as a stream
+func serveForward(c shared.Client, peerID string, f *forward) {
+	ln, err := net.Listen("tcp", f.listen)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer ln.Close()
+	log.Printf("forwarding %s to %s through %s", f.listen, f.target, peerID)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Print(err)
+			return
+		}
+
+		go func() {
+			st, err := c.OpenStream(peerID, forwardPrefix+f.target)
+			if err != nil {
+				log.Print(err)
+				conn.Close()
+				return
+			}
+			pipe(conn.(*net.TCPConn), st)
+		}()
+	}
+}
+
+// acceptForwards connects the streams the peer of the session opens to their
+// targets when the allowlist permits it
+func acceptForwards(c shared.Client, s *shared.Session, allowed allowlist) {
+	peer := s.GetPeer()
+	for {
+		st, err := c.AcceptStream(peer.ID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+
+		target := strings.TrimPrefix(st.Name, forwardPrefix)
+		if !strings.HasPrefix(st.Name, forwardPrefix) || !allowed[target] {
+			log.Printf("refusing stream to %q from %s", st.Name, peer.Username)
+			st.Reset()
+			continue
+		}
+
+		go func() {
+			conn, err := net.DialTimeout("tcp", target, dialTimeout)
+			if err != nil {
+				log.Print(err)
+				st.Reset()
+				return
+			}
+			log.Printf("%s connected to %s", peer.Username, target)
+			pipe(conn.(*net.TCPConn), st)
+		}()
+	}
+}
+
+// pipe copies bytes both ways until both sides have finished writing
+func pipe(conn *net.TCPConn, s *shared.Stream) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		_, err := io.Copy(s, conn)
+		if err != nil {
+			s.Reset()
+			return
+		}
+		s.Close()
+	}()
+
+	go func() {
+		defer wg.Done()
+		_, err := io.Copy(conn, s)
+		if err != nil {
+			// the stream was reset, drop the connection
+			conn.Close()
+			return
+		}
+		conn.CloseWrite()
+	}()
+
+	wg.Wait()
+	conn.Close()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	re "github.com/wilfreddenton/reDo"
+	"github.com/wilfreddenton/udp-hole-punching/shared"
+	"github.com/wilfreddenton/udp-hole-punching/udp_client"
+)
+
+const serverUDPPort = ":9001"
+
+const usage = `usage: forward [flags]
+
+Forwards local TCP ports through a hole punched connection, like ssh -L.
+One side dials the other with -peer, either side may forward ports with -L
+and each side only connects to the targets it allows with -allow. Streams
+are accepted from the -peer that was dialed or, with -accept verified, from
+the peers whose safety number was verified.
+
+flags:
+`
+
+var (
+	serverUDPIP = "127.0.0.1"
+	serverIP    = flag.String("serverIP", "", "IP address of rendezvous server")
+	identity    = flag.String("identity", "", "Path of the identity key file to use")
+	username    = flag.String("username", "forward", "Username to register with")
+	peerID      = flag.String("peer", "", "ID of the peer to connect to, empty to wait for the peer")
+	accept      = flag.String("accept", "peer", "Whose forwards to accept, the dialed \"peer\" or any \"verified\" peer")
+	locals      = forwards{}
+	allowed     = allowlist{}
+)
+
+func main() {
+	flag.Var(&locals, "L", "Forward [bind:]port:host:hostport through the peer, may be repeated")
+	flag.Var(allowed, "allow", "Comma separated host:port targets the peer may connect to")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *accept != "peer" && *accept != "verified" {
+		log.Fatalf("-accept must be peer or verified, not %q", *accept)
+	}
+	if *accept == "peer" && *peerID == "" && len(allowed) > 0 {
+		log.Fatal("-allow without -peer needs -accept verified")
+	}
+
+	if *serverIP != "" {
+		serverUDPIP = *serverIP
+	}
+
+	var err error
+	var store *shared.IdentityStore
+	if *identity != "" {
+		store, err = shared.OpenIdentityStore(*identity, "Passphrase for "+*identity+": ")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	sAddr, err := net.ResolveUDPAddr("udp", serverUDPIP+serverUDPPort)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var c *udp_client.Client
+	err = re.Do(5, func() error {
+		addr, err := net.ResolveUDPAddr("udp", shared.GenPort())
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		c, err = udp_client.New(*username, store, addr, sAddr)
+		return err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	c.OnRegistered(func(c shared.Client) {
+		log.Printf("registered as %s", c.GetSelf().ID)
+		if *peerID == "" {
+			log.Print("waiting for a peer to connect")
+			return
+		}
+		err := c.Establish(*peerID)
+		if err != nil {
+			log.Fatal(err)
+		}
+	})
+	// the local ports stay open across reconnects, their connections go
+	// to whichever session with the peer is current
+	var listen sync.Once
+	c.OnConnected(func(c shared.Client, s *shared.Session) {
+		peer := s.GetPeer()
+		log.Printf("connected to %s (%s), safety number %s", peer.Username, peer.ID, s.GetSAS())
+		if !c.GetVerifiedPeers().IsVerified(peer.ID) {
+			log.Print("this peer is not verified, compare the safety number out of band")
+		}
+
+		// local ports are forwarded to the peer that was dialed
+		if peer.ID == *peerID {
+			listen.Do(func() {
+				for _, f := range locals {
+					go serveForward(c, peer.ID, f)
+				}
+			})
+		}
+
+		// streams of peers whose forwards are not accepted are refused
+		switch {
+		case *accept == "peer" && peer.ID == *peerID:
+			go acceptForwards(c, s, allowed)
+		case *accept == "verified" && c.GetVerifiedPeers().IsVerified(peer.ID):
+			go acceptForwards(c, s, allowed)
+		default:
+			log.Printf("not accepting forwards from %s", peer.Username)
+			go acceptForwards(c, s, nil)
+		}
+	})
+	c.OnPunch(func(c shared.Client, s *shared.Session, r *shared.PunchResult) {
+		log.Printf("punching through to %s %s after %d attempts, %d with a low TTL, in %s (%s)", s.GetPeer().Username, r.Outcome, r.Attempts, r.LowTTLAttempts, r.Elapsed.Round(time.Millisecond), r.Mode)
+	})
+	c.OnDisconnected(func(c shared.Client, s *shared.Session, reason string) {
+		log.Printf("disconnected from %s: %s", s.GetPeer().Username, reason)
+	})
+	c.OnError(func(c shared.Client, e *shared.Error) {
+		// without the peer there is nothing to forward to
+		if e.Kind == shared.FatalError || (e.Type == "establish" && e.FromServer(c)) {
+			log.Fatalf("%s", e)
+		}
+		log.Printf("%s error handling %s message: %s", e.Kind, e.Type, e)
+	})
+
+	err = c.Start(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	exit := make(chan os.Signal, 1)
+	signal.Notify(exit, syscall.SIGINT, syscall.SIGTERM)
+	log.Println(<-exit)
+
+	c.Stop()
+}
@@ -1,40 +1,122 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
 
 	"github.com/googollee/go-socket.io"
 	"github.com/wilfreddenton/udp-hole-punching/shared"
 )
 
+// peerEvent is what every event about a session carries, the UI keeps a
+// conversation per peer ID
+type peerEvent struct {
+	PeerID string      `json:"peerID"`
+	Data   interface{} `json:"data"`
+}
+
+// session describes a peer session to the UI
+type session struct {
+	Username string `json:"username"`
+	Addr     string `json:"addr"`
+	SAS      string `json:"sas"`
+	Verified bool   `json:"verified"`
+	Dialed   bool   `json:"dialed"`
+}
+
+func newSession(c shared.Client, s *shared.Session) *session {
+	peer := s.GetPeer()
+	return &session{
+		Username: peer.Username,
+		Addr:     s.GetConn().GetAddr().String(),
+		SAS:      s.GetSAS(),
+		Verified: c.GetVerifiedPeers().IsVerified(peer.ID),
+		Dialed:   s.Dialed(),
+	}
+}
+
+// emitPeer sends the event about the session with the peer ID to the UI
+func emitPeer(so socketio.Socket, event, peerID string, data interface{}) {
+	b, err := json.Marshal(&peerEvent{PeerID: peerID, Data: data})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	so.Emit(event, string(b))
+}
+
 func createRegisteredCallback(so socketio.Socket) func(shared.Client) {
 	return func(c shared.Client) {
 		so.Emit("enter", c.GetSelf().ID)
 	}
 }
 
-func createConnectingCallback(so socketio.Socket) func(shared.Client) {
-	return func(c shared.Client) {
-		peer := c.GetPeer()
-		pConn := c.GetPeerConn()
-
+func createConnectingCallback(so socketio.Socket) func(shared.Client, *shared.Session) {
+	return func(c shared.Client, s *shared.Session) {
 		fmt.Println("connecting")
-		so.Emit("connecting", fmt.Sprintf(`{
-			"username": "%s",
-			"id": "%s",
-			"addr": "%s"
-		}`, peer.Username, peer.ID, pConn.GetAddr()))
+		emitPeer(so, "connecting", s.GetPeer().ID, newSession(c, s))
 	}
 }
 
-func createConnectedCallback(so socketio.Socket) func(shared.Client) {
-	return func(c shared.Client) {
-		so.Emit("connected")
+func createConnectedCallback(so socketio.Socket) func(shared.Client, *shared.Session) {
+	return func(c shared.Client, s *shared.Session) {
+		emitPeer(so, "connected", s.GetPeer().ID, newSession(c, s))
+	}
+}
+
+func createDisconnectedCallback(so socketio.Socket) func(shared.Client, *shared.Session, string) {
+	return func(c shared.Client, s *shared.Session, reason string) {
+		emitPeer(so, "disconnected", s.GetPeer().ID, reason)
+	}
+}
+
+func createMessageCallback(so socketio.Socket) func(shared.Client, *shared.Session, *shared.Chat) {
+	return func(c shared.Client, s *shared.Session, chat *shared.Chat) {
+		emitPeer(so, "message", s.GetPeer().ID, chat)
+	}
+}
+
+func createReceiptCallback(so socketio.Socket) func(shared.Client, *shared.Session, *shared.Receipt) {
+	return func(c shared.Client, s *shared.Session, r *shared.Receipt) {
+		emitPeer(so, "receipt", s.GetPeer().ID, r)
+	}
+}
+
+func createPeerSignalCallback(so socketio.Socket) func(shared.Client, *shared.Session, *shared.Signal) {
+	return func(c shared.Client, s *shared.Session, sig *shared.Signal) {
+		if sig.Name == shared.TypingSignal {
+			emitPeer(so, "typing", s.GetPeer().ID, sig.Active)
+		}
+	}
+}
+
+func createFileOfferCallback(so socketio.Socket) func(shared.Client, *shared.Session, *shared.Transfer) {
+	return func(c shared.Client, s *shared.Session, t *shared.Transfer) {
+		emitPeer(so, "offer", t.PeerID, t)
+	}
+}
+
+// createFileProgressCallback emits upload events for files being sent and
+// download events for files being received
+func createFileProgressCallback(so socketio.Socket) func(shared.Client, *shared.Session, *shared.Transfer) {
+	return func(c shared.Client, s *shared.Session, t *shared.Transfer) {
+		if t.Sending {
+			emitPeer(so, "upload", t.PeerID, t)
+		} else {
+			emitPeer(so, "download", t.PeerID, t)
+		}
 	}
 }
 
-func createMessageCallback(so socketio.Socket) func(shared.Client, string) {
-	return func(c shared.Client, text string) {
-		so.Emit("message", text)
+// createErrorCallback shows the user the errors they can act on, requests the
+// server refused and fatal errors. A session that fails is reported as a
+// disconnection.
+func createErrorCallback(so socketio.Socket) func(shared.Client, *shared.Error) {
+	return func(c shared.Client, e *shared.Error) {
+		log.Printf("%s error handling %s message: %s", e.Kind, e.Type, e)
+		if e.Kind == shared.FatalError || (e.Kind == shared.IgnorableError && e.FromServer(c)) {
+			so.Emit("failure", e.Error())
+		}
 	}
 }
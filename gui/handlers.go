@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/googollee/go-socket.io"
+	"github.com/wilfreddenton/udp-hole-punching/shared"
 	"github.com/wilfreddenton/udp-hole-punching/udp_client"
 )
 
@@ -27,8 +36,38 @@ func enterHandler(so socketio.Socket, s *state, u *user) {
 	}
 
 	fmt.Println("set client")
-	s.client, err = udp_client.New(s.username, addr, sAddr)
-	err = s.client.Start()
+	s.client, err = udp_client.New(s.username, s.store, addr, sAddr)
+	if err != nil {
+		log.Print(err)
+		so.Emit("error", err.Error())
+		return
+	}
+
+	policy := shared.DefaultRekeyPolicy
+	policy.Messages = *rekeyCount
+	policy.Interval = *rekeyTime
+	s.client.SetRekeyPolicy(policy)
+	s.client.SetKeepalivePolicy(shared.KeepalivePolicy{
+		Interval:  *keepalive,
+		MaxMissed: *maxMissed,
+	})
+	intervals, err := shared.ParseIntervals(*punchIntervals)
+	if err != nil {
+		log.Print(err)
+		so.Emit("error", err.Error())
+		return
+	}
+	s.client.SetPunchStrategy(shared.PunchStrategy{
+		Attempts:       *punchAttempts,
+		Intervals:      intervals,
+		Burst:          *punchBurst,
+		Jitter:         *punchJitter,
+		Deadline:       *punchDeadline,
+		LowTTL:         *punchTTL,
+		LowTTLAttempts: *punchTTLCount,
+	})
+
+	err = s.client.Start(context.Background())
 	if err != nil {
 		log.Print(err)
 		so.Emit("error", err.Error())
@@ -38,7 +77,77 @@ func enterHandler(so socketio.Socket, s *state, u *user) {
 	s.client.OnRegistered(createRegisteredCallback(so))
 	s.client.OnConnecting(createConnectingCallback(so))
 	s.client.OnConnected(createConnectedCallback(so))
+	s.client.OnDisconnected(createDisconnectedCallback(so))
 	s.client.OnMessage(createMessageCallback(so))
+	s.client.OnReceipt(createReceiptCallback(so))
+	s.client.OnPeerSignal(createPeerSignalCallback(so))
+	s.client.OnFileOffer(createFileOfferCallback(so))
+	s.client.OnFileProgress(createFileProgressCallback(so))
+	s.client.OnError(createErrorCallback(so))
 
 	s.id = s.client.GetSelf().ID
 }
+
+// uploadHandler stores a file picked in the UI and offers it to the peer
+// named by the peerID form field
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || STATE.client == nil {
+		http.Error(w, "not connected to a peer", http.StatusBadRequest)
+		return
+	}
+
+	f, fh, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	path := filepath.Join(dir, filepath.Base(fh.Filename))
+	out, err := os.Create(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = io.Copy(out, f)
+	out.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	t, err := STATE.client.SendFile(r.FormValue("peerID"), path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// downloadHandler serves a file received from the peer
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	if STATE.client == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// the path is /download/<peer ID>/<file ID>
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/download/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	path, err := STATE.client.GetTransfers().Path(parts[0], parts[1])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+	http.ServeFile(w, r, path)
+}
@@ -20,20 +20,59 @@ type user struct {
 	Protocol string `json:"protocol"`
 }
 
+// outgoing is a chat message typed in the UI, the key identifies it until
+// the client has assigned it an ID
+type outgoing struct {
+	PeerID string `json:"peerID"`
+	Key    int    `json:"key"`
+	Text   string `json:"text"`
+}
+
+// read tells the peer a received message has been displayed
+type read struct {
+	PeerID string `json:"peerID"`
+	ID     string `json:"id"`
+}
+
+// accept is a file offered by the peer the user wants to receive
+type accept struct {
+	PeerID string `json:"peerID"`
+	ID     string `json:"id"`
+}
+
+// typing is whether the user is typing in the conversation with the peer
+type typing struct {
+	PeerID string `json:"peerID"`
+	Active bool   `json:"active"`
+}
+
 const (
 	serverUDPPort = ":9001"
 	serverTCPPort = ":7001"
 )
 
 var (
-	serverTCPIP = "0.0.0.0"
-	serverUDPIP = "127.0.0.1"
-	useCors     = flag.Bool("cors", false, "Use CORS or not")
-	serverIP    = flag.String("serverIP", "", "IP address of rendezvous server")
-	STATE       = &state{}
+	serverTCPIP    = "0.0.0.0"
+	serverUDPIP    = "127.0.0.1"
+	useCors        = flag.Bool("cors", false, "Use CORS or not")
+	serverIP       = flag.String("serverIP", "", "IP address of rendezvous server")
+	identity       = flag.String("identity", "", "Path of the identity key file to use")
+	rekeyCount     = flag.Uint64("rekeyMessages", shared.DefaultRekeyPolicy.Messages, "Rotate session keys after this many messages (0 disables)")
+	rekeyTime      = flag.Duration("rekeyInterval", shared.DefaultRekeyPolicy.Interval, "Rotate session keys after this long (0 disables)")
+	keepalive      = flag.Duration("keepalive", shared.DefaultKeepalivePolicy.Interval, "Ping the peer this often (0 disables)")
+	maxMissed      = flag.Int("maxMissed", shared.DefaultKeepalivePolicy.MaxMissed, "Disconnect after this many unanswered pings")
+	punchAttempts  = flag.Int("punchAttempts", shared.DefaultPunchStrategy.Attempts, "Give up punching through to a peer after this many attempts")
+	punchIntervals = flag.String("punchIntervals", "3s", "Comma separated waits between punch attempts, the last one repeats")
+	punchBurst     = flag.Int("punchBurst", shared.DefaultPunchStrategy.Burst, "Send the first punch this many times")
+	punchJitter    = flag.Duration("punchJitter", shared.DefaultPunchStrategy.Jitter, "Add up to this much at random to each wait")
+	punchDeadline  = flag.Duration("punchDeadline", shared.DefaultPunchStrategy.Deadline, "Give up punching after this long (0 leaves it to the attempts)")
+	punchTTL       = flag.Int("punchTTL", shared.DefaultPunchStrategy.LowTTL, "Send the first punches with this low TTL (0 disables)")
+	punchTTLCount  = flag.Int("punchTTLAttempts", shared.DefaultPunchStrategy.LowTTLAttempts, "How many of the first punch attempts use the low TTL")
+	STATE          = &state{}
 )
 
 type state struct {
+	store    *shared.IdentityStore
 	username string
 	protocol string
 	id       string
@@ -52,6 +91,17 @@ func main() {
 		serverUDPIP = *serverIP
 	}
 
+	// unlock the identity before serving the UI
+	var err error
+	if *identity != "" {
+		STATE.store, err = shared.OpenIdentityStore(*identity, "Passphrase for "+*identity+": ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		id, _ := shared.ReadIdentityID(*identity)
+		fmt.Println("using identity", id)
+	}
+
 	server, err := socketio.NewServer(nil)
 	if err != nil {
 		log.Fatal(err)
@@ -73,20 +123,96 @@ func main() {
 		// when user enters peerID
 		so.On("establish", func(peerID string) {
 			fmt.Println("establish")
-			STATE.client.GetServerConn().Send(&shared.Message{
-				Type:    "establish",
-				PeerID:  STATE.id,
-				Content: peerID,
-			})
+			err := STATE.client.Establish(peerID)
+			if err != nil {
+				log.Print(err)
+				so.Emit("error", err.Error())
+			}
 		})
 		// when user sends a message
-		so.On("message", func(text string) {
-			fmt.Println("message:", text)
-			STATE.client.GetPeerConn().Send(&shared.Message{
-				Type:    "message",
-				PeerID:  STATE.id,
-				Content: text,
-			})
+		so.On("message", func(msg string) {
+			o := &outgoing{}
+			err := json.Unmarshal([]byte(msg), o)
+			if err != nil {
+				log.Print(err)
+				so.Emit("error", err.Error())
+				return
+			}
+
+			fmt.Println("message:", o.Text)
+			chat, err := STATE.client.SendMessage(o.PeerID, o.Text)
+			if err != nil {
+				log.Print(err)
+				so.Emit("error", err.Error())
+				return
+			}
+			// tell the UI which ID receipts for its message will carry
+			emitPeer(so, "sent", o.PeerID, map[string]interface{}{"key": o.Key, "id": chat.ID})
+		})
+		// when a received message has been displayed
+		so.On("read", func(msg string) {
+			r := &read{}
+			err := json.Unmarshal([]byte(msg), r)
+			if err == nil {
+				err = STATE.client.MarkRead(r.PeerID, r.ID)
+			}
+			if err != nil {
+				log.Print(err)
+			}
+		})
+		// when user starts or stops typing
+		so.On("typing", func(msg string) {
+			t := &typing{}
+			err := json.Unmarshal([]byte(msg), t)
+			if err == nil {
+				err = STATE.client.SendSignal(t.PeerID, shared.TypingSignal, t.Active)
+			}
+			if err != nil {
+				log.Print(err)
+			}
+		})
+		// when user accepts a file offered by the peer
+		so.On("accept", func(msg string) {
+			a := &accept{}
+			err := json.Unmarshal([]byte(msg), a)
+			if err == nil {
+				err = STATE.client.AcceptFile(a.PeerID, a.ID)
+			}
+			if err != nil {
+				log.Print(err)
+				so.Emit("error", err.Error())
+				return
+			}
+			// files with nothing left to receive complete right away
+			if t, ok := STATE.client.GetTransfers().Received(a.PeerID, a.ID); ok && t.Complete {
+				s, _ := STATE.client.GetSessions().Get(t.PeerID)
+				createFileProgressCallback(so)(STATE.client, s, t)
+			}
+		})
+		// when user confirms the safety number of a peer
+		so.On("verify", func(peerID string) {
+			fmt.Println("verify")
+			s, ok := STATE.client.GetSessions().Get(peerID)
+			if !ok {
+				so.Emit("error", "not connected to peer "+peerID)
+				return
+			}
+			err := STATE.client.GetVerifiedPeers().Add(s.GetPeer())
+			if err != nil {
+				log.Print(err)
+				so.Emit("error", err.Error())
+				return
+			}
+			emitPeer(so, "verified", peerID, true)
+		})
+		// when user leaves a conversation
+		so.On("leave", func(peerID string) {
+			fmt.Println("leave")
+			err := STATE.client.Disconnect(peerID, "peer left the conversation")
+			if err != nil {
+				log.Print(err)
+			}
+			emitPeer(so, "disconnected", peerID, "you left the conversation")
 		})
 		// when user resets chat
 		so.On("reset", func(text string) {
@@ -108,6 +234,8 @@ func main() {
 	mux := http.NewServeMux()
 	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./ui/dist/static"))))
 	mux.Handle("/socket.io/", server)
+	mux.HandleFunc("/upload", uploadHandler)
+	mux.HandleFunc("/download/", downloadHandler)
 	mux.HandleFunc("/", indexHandler)
 
 	handler := http.Handler(mux)
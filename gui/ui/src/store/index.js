@@ -2,28 +2,42 @@ import Vue from 'vue'
 import Vuex from 'vuex'
 import createLogger from 'vuex/dist/logger'
 import messages from './modules/messages'
+import transfers from './modules/transfers'
 import * as types from './mutation-types'
 
 Vue.use(Vuex)
 
 const debug = process.env.NODE_ENV !== 'production'
 
+// the session to show once the active one ends
+const nextActive = (state, peerID) => {
+  return Object.keys(state.sessions).find(id => id !== peerID) || ''
+}
+
 export default new Vuex.Store({
   state: {
     socketConnected: false,
     entered: false,
-    connecting: false,
-    connected: false,
     message: null,
     username: '',
     protocol: 'TCP',
     id: '',
+    // the peer ID typed into the connect form
     peerID: '',
-    peerUsername: '',
-    peerAddr: ''
+    // peer sessions keyed by peer ID
+    sessions: {},
+    // the peer ID of the conversation on screen
+    active: '',
+    // whether the connect form is shown over the conversations
+    adding: false,
+    // why the last peer session ended
+    disconnectReason: '',
+    // the last request of the user that failed
+    failure: ''
   },
   modules: {
-    messages
+    messages,
+    transfers
   },
   mutations: {
     [types.SOCKET_CONNECT]: (state, status) => {
@@ -31,23 +45,85 @@ export default new Vuex.Store({
     },
     [types.SOCKET_CONNECTING]: (state, objStr) => {
       console.log('connecting')
-      const { username, addr } = JSON.parse(objStr)
-      state.peerUsername = username
-      state.peerAddr = addr
-      state.entered = false
-      state.connecting = true
+      const { peerID, data } = JSON.parse(objStr)
+      Vue.set(state.sessions, peerID, { ...data, id: peerID, connected: false, typing: 0, unread: 0 })
+      // a conversation the user started is the one they want to see
+      if (data.dialed || state.active === '') {
+        state.active = peerID
+        state.adding = false
+      }
     },
-    [types.SOCKET_CONNECTED]: (state) => {
+    [types.SOCKET_CONNECTED]: (state, objStr) => {
       console.log('connected')
-      state.entered = false
-      state.connecting = false
-      state.connected = true
+      const { peerID, data } = JSON.parse(objStr)
+      const s = state.sessions[peerID]
+      if (!s) {
+        return
+      }
+      state.sessions[peerID] = { ...s, sas: data.sas, verified: data.verified, connected: true }
+      state.disconnectReason = ''
+      state.failure = ''
+    },
+    [types.SOCKET_DISCONNECTED]: (state, objStr) => {
+      console.log('disconnected')
+      const { peerID, data } = JSON.parse(objStr)
+      const s = state.sessions[peerID]
+      if (!s) {
+        return
+      }
+      state.disconnectReason = `${s.username}: ${data}`
+      if (state.active === peerID) {
+        state.active = nextActive(state, peerID)
+      }
+      Vue.delete(state.sessions, peerID)
+    },
+    [types.SOCKET_MESSAGE]: (state, objStr) => {
+      const { peerID } = JSON.parse(objStr)
+      const s = state.sessions[peerID]
+      if (s && peerID !== state.active) {
+        state.sessions[peerID] = { ...s, unread: s.unread + 1 }
+      }
+    },
+    [types.SOCKET_VERIFIED]: (state, objStr) => {
+      const { peerID } = JSON.parse(objStr)
+      const s = state.sessions[peerID]
+      if (s) {
+        state.sessions[peerID] = { ...s, verified: true }
+      }
+    },
+    [types.SOCKET_TYPING]: (state, objStr) => {
+      const { peerID, data } = JSON.parse(objStr)
+      const s = state.sessions[peerID]
+      if (s) {
+        state.sessions[peerID] = { ...s, typing: data ? Date.now() : 0 }
+      }
+    },
+    [types.STOP_PEER_TYPING]: (state, peerID) => {
+      const s = state.sessions[peerID]
+      if (s) {
+        state.sessions[peerID] = { ...s, typing: 0 }
+      }
+    },
+    [types.SOCKET_FAILURE]: (state, failure) => {
+      state.failure = failure
     },
     [types.SOCKET_ENTER]: (state, id) => {
       console.log('entered')
       state.id = id
       state.entered = true
     },
+    [types.SWITCH_SESSION]: (state, peerID) => {
+      const s = state.sessions[peerID]
+      if (!s) {
+        return
+      }
+      state.sessions[peerID] = { ...s, unread: 0 }
+      state.active = peerID
+      state.adding = false
+    },
+    [types.SHOW_CONNECT]: (state, show) => {
+      state.adding = show
+    },
     [types.UPDATE_PROTOCOL]: (state, protocol) => {
       state.protocol = protocol
     },
@@ -68,6 +144,15 @@ export default new Vuex.Store({
     updatePeerID: ({ commit }, peerID) => {
       commit(types.UPDATE_PEER_ID, peerID)
     },
+    stopPeerTyping: ({ commit }, peerID) => {
+      commit(types.STOP_PEER_TYPING, peerID)
+    },
+    switchSession: ({ commit }, peerID) => {
+      commit(types.SWITCH_SESSION, peerID)
+    },
+    showConnect: ({ commit }, show) => {
+      commit(types.SHOW_CONNECT, show)
+    },
     otherAction: (context, type) => {
       return true
     }
@@ -75,12 +160,21 @@ export default new Vuex.Store({
   getters: {
     username: state => state.username,
     protocol: state => state.protocol,
-    entered: state => state.entered,
-    connecting: state => state.connecting,
-    connected: state => state.connected,
+    // the connect form shows until there is a session or while adding one
+    entered: state => state.entered && (state.active === '' || state.adding),
+    connecting: (state, getters) => !getters.entered && getters.session !== null && !getters.session.connected,
+    connected: (state, getters) => !getters.entered && getters.session !== null && getters.session.connected,
+    sessions: state => Object.keys(state.sessions).map(id => state.sessions[id]).sort((a, b) => a.username.localeCompare(b.username)),
+    session: state => state.sessions[state.active] || null,
+    active: state => state.active,
     peerID: state => state.peerID,
-    peerUsername: state => state.peerUsername,
-    peerAddr: state => state.peerAddr,
+    peerUsername: (state, getters) => getters.session ? getters.session.username : '',
+    peerAddr: (state, getters) => getters.session ? getters.session.addr : '',
+    sas: (state, getters) => getters.session ? getters.session.sas : '',
+    verified: (state, getters) => getters.session ? getters.session.verified : false,
+    peerTyping: (state, getters) => getters.session ? getters.session.typing : 0,
+    disconnectReason: state => state.disconnectReason,
+    failure: state => state.failure,
     id: state => state.id
   },
   strict: debug,
@@ -1,11 +1,13 @@
+import Vue from 'vue'
 import * as types from '../mutation-types'
 
+// messages keyed by the peer ID of their conversation
 const state = {
-  messages: []
+  messages: {}
 }
 
 const getters = {
-  messages: state => state.messages
+  messages: (state, getters, rootState) => state.messages[rootState.active] || []
 }
 
 const actions = {
@@ -14,12 +16,39 @@ const actions = {
   }
 }
 
+const add = (state, peerID, msg) => {
+  Vue.set(state.messages, peerID, (state.messages[peerID] || []).concat([msg]))
+}
+
 const mutations = {
   [types.NEW_MESSAGE] (state, msg) {
-    state.messages = state.messages.concat([msg])
+    add(state, msg.peerID, msg)
+  },
+  // a new conversation with the peer starts with an empty history
+  [types.SOCKET_DISCONNECTED] (state, objStr) {
+    const { peerID } = JSON.parse(objStr)
+    Vue.delete(state.messages, peerID)
+  },
+  [types.SOCKET_MESSAGE] (state, objStr) {
+    const { peerID, data: { id, text } } = JSON.parse(objStr)
+    add(state, peerID, { sent: false, peerID, id, text })
+  },
+  // the client has assigned an ID to a message sent from the chat bar
+  [types.SOCKET_SENT] (state, objStr) {
+    const { peerID, data: { key, id } } = JSON.parse(objStr)
+    const messages = state.messages[peerID] || []
+    Vue.set(state.messages, peerID, messages.map(m => m.key === key ? { ...m, id, state: 'sent' } : m))
   },
-  [types.SOCKET_MESSAGE] (state, text) {
-    state.messages = state.messages.concat([{ sent: false, text }])
+  [types.SOCKET_RECEIPT] (state, objStr) {
+    const { peerID, data: { id, state: s } } = JSON.parse(objStr)
+    const messages = state.messages[peerID] || []
+    Vue.set(state.messages, peerID, messages.map(m => {
+      // never move a read message back to delivered
+      if (m.id !== id || m.state === 'read') {
+        return m
+      }
+      return { ...m, state: s }
+    }))
   }
 }
 
@@ -0,0 +1,32 @@
+import * as types from '../mutation-types'
+
+const state = {
+  transfers: []
+}
+
+const getters = {
+  // the transfers of the conversation on screen
+  transfers: (state, getters, rootState) => state.transfers.filter(t => t.peerID === rootState.active)
+}
+
+// update replaces the transfer with the same ID or adds it
+const update = (state, objStr) => {
+  const { data: t } = JSON.parse(objStr)
+  if (state.transfers.some(o => o.id === t.id)) {
+    state.transfers = state.transfers.map(o => o.id === t.id ? t : o)
+  } else {
+    state.transfers = state.transfers.concat([t])
+  }
+}
+
+const mutations = {
+  [types.SOCKET_OFFER]: update,
+  [types.SOCKET_UPLOAD]: update,
+  [types.SOCKET_DOWNLOAD]: update
+}
+
+export default {
+  state,
+  getters,
+  mutations
+}
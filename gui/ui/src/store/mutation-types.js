@@ -2,8 +2,20 @@ export const SOCKET_CONNECT = 'SOCKET_CONNECT'
 export const SOCKET_ENTER = 'SOCKET_ENTER'
 export const SOCKET_CONNECTING = 'SOCKET_CONNECTING'
 export const SOCKET_CONNECTED = 'SOCKET_CONNECTED'
+export const SOCKET_DISCONNECTED = 'SOCKET_DISCONNECTED'
 export const SOCKET_MESSAGE = 'SOCKET_MESSAGE'
+export const SOCKET_SENT = 'SOCKET_SENT'
+export const SOCKET_RECEIPT = 'SOCKET_RECEIPT'
+export const SOCKET_TYPING = 'SOCKET_TYPING'
+export const SOCKET_OFFER = 'SOCKET_OFFER'
+export const SOCKET_UPLOAD = 'SOCKET_UPLOAD'
+export const SOCKET_DOWNLOAD = 'SOCKET_DOWNLOAD'
+export const SOCKET_VERIFIED = 'SOCKET_VERIFIED'
+export const SOCKET_FAILURE = 'SOCKET_FAILURE'
 export const UPDATE_PROTOCOL = 'UPDATE_PROTOCOL'
 export const UPDATE_USERNAME = 'UPDATE_USERNAME'
 export const UPDATE_PEER_ID = 'UPDATE_PEER_ID'
+export const STOP_PEER_TYPING = 'STOP_PEER_TYPING'
+export const SWITCH_SESSION = 'SWITCH_SESSION'
+export const SHOW_CONNECT = 'SHOW_CONNECT'
 export const NEW_MESSAGE = 'NEW_MESSAGE'
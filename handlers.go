@@ -1,121 +1,714 @@
 package main
 
 import (
-	"encoding/base64"
 	"errors"
-	"fmt"
 	"log"
+	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/mitchellh/mapstructure"
-	"github.com/wilfreddenton/crypto"
 	"github.com/wilfreddenton/udp-hole-punching/shared"
 )
 
-func greetingHandler(conn shared.Conn, m *shared.Message) (*shared.Message, error) {
-	// ensure that public key was sent in greeting request
-	str, ok := m.Content.(string)
-	if !ok {
-		return nil, errors.New("greeting request must contain client's public key")
+func handshakeHandler(conn shared.Conn, m *shared.Message) (*shared.Message, error) {
+	// ensure that a handshake message was sent
+	var hm shared.HandshakeMessage
+	err := mapstructure.Decode(m.Content, &hm)
+	if err != nil {
+		return nil, shared.NewProtocolError(shared.Malformed, "handshake request is malformed")
 	}
 
-	// get public key contained in content
-	bs, err := base64.StdEncoding.DecodeString(str)
+	reply, complete, err := shared.HandleHandshake(conn, keys, &hm)
 	if err != nil {
-		return nil, err
+		return nil, shared.NewProtocolError(shared.HandshakeFailed, "%s", err)
+	}
+
+	// install the transport keys once the client has authenticated
+	if complete {
+		h := conn.GetHandshake()
+		conn.SetCipher(shared.NewRatchet(h.Root(), h.Initiator()))
+		log.Printf("Completed handshake with client at %s", conn.GetAddr())
 	}
 
-	// create shared secret from private key and peer public key
-	var clientPubKey [32]byte
-	copy(clientPubKey[:], bs[:])
-	conn.SetSecret(crypto.GenSharedSecret(priKey, clientPubKey))
+	if reply == nil {
+		return nil, nil
+	}
 
-	// send greeting response
+	// send handshake response
 	return &shared.Message{
-		Type:    "greeting",
-		Content: base64.StdEncoding.EncodeToString(pubKey[:]),
+		Type:    "handshake",
+		Content: reply,
 	}, nil
 }
 
 // register the requesting peer in the server
-func registerHandler(peers shared.Peers, c shared.Conn, m *shared.Message) (*shared.Message, error) {
+func registerHandler(peers *registry, box *mailbox, cl *clocks, c shared.Conn, m *shared.Message) (*shared.Message, error) {
+	// registration is only accepted over the handshake's transport keys
+	h := c.GetHandshake()
+	if !m.WasEncrypted() || h == nil || !h.Complete() {
+		return nil, shared.NewProtocolError(shared.Unauthorized, "client must complete the handshake before registering")
+	}
+
+	// the ID must belong to the key the client authenticated with
+	pubKey := h.RemoteStatic()
+	if shared.GenID(pubKey) != m.PeerID {
+		return nil, shared.NewProtocolError(shared.Unauthorized, "peer ID does not match the client's public key")
+	}
+
 	// map -> structure the content
 	var registration shared.Registration
 	err := mapstructure.Decode(m.Content, &registration)
 	if err != nil {
-		return nil, err
+		return nil, shared.NewProtocolError(shared.Malformed, "registration is malformed")
 	}
 
 	// register peer
-	endpoint := strings.Split(c.GetAddr().String(), ":")
-	if len(endpoint) != 2 {
-		return nil, errors.New("address is not valid")
-	}
-
-	port, err := strconv.Atoi(endpoint[1])
+	endpoint, err := toEndpoint(c.GetAddr())
 	if err != nil {
 		return nil, err
 	}
 
-	peers[m.PeerID] = &shared.Peer{
+	p := &shared.Peer{
 		ID:       m.PeerID,
 		Username: registration.Username,
-		Endpoint: shared.Endpoint{
-			IP:   endpoint[0],
-			Port: port,
-		},
+		Endpoint: endpoint,
 	}
+	p.SetPublicKey(pubKey)
+	peers.put(p)
 	log.Printf("Registered peer: %s at addr %s", m.PeerID, c.GetAddr().String())
+	deliverMail(box, c, m.PeerID)
+	// clients register again every keepalive interval, which keeps the
+	// reading of their clock fresh
+	cl.probe(c)
 
-	// confirm registry to peer
+	// confirm registry to peer and tell it the endpoint it was seen at
 	return &shared.Message{
 		Type:    "register",
+		Content: endpoint,
 		Encrypt: true,
 	}, nil
 }
 
-// facilitate in the establishing of the p2p connection
-func establishHandler(peers shared.Peers, conns shared.Conns, m *shared.Message) (*shared.Message, error) {
+// migrateHandler keeps the endpoint of a registered peer up to date when its
+// session moves to a new address
+func migrateHandler(peers *registry, c shared.Conn, prev net.Addr) error {
+	endpoint, err := toEndpoint(c.GetAddr())
+	if err != nil {
+		return err
+	}
+
+	// the session belongs to the peer whose key completed its handshake
+	h := c.GetHandshake()
+	if h == nil || !h.Complete() {
+		return nil
+	}
+	id := shared.GenID(h.RemoteStatic())
+	if peers.move(id, prev, endpoint) {
+		log.Printf("Peer %s moved from %s to %s", id, prev, endpoint)
+	}
+	return nil
+}
+
+// registry is the peers registered with the server by ID. A registered Peer
+// is never changed, a peer that moves is replaced, so handlers may keep one
+// after the lock is released.
+type registry struct {
+	peers shared.Peers
+	m     *sync.Mutex
+}
+
+func (r *registry) get(id string) (*shared.Peer, bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	p, ok := r.peers[id]
+	return p, ok
+}
+
+func (r *registry) put(p *shared.Peer) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.peers[p.ID] = p
+}
+
+// move changes the endpoint of the peer with the ID if it is still
+// registered at prev
+func (r *registry) move(id string, prev net.Addr, endpoint shared.Endpoint) bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+	p, ok := r.peers[id]
+	if !ok || p.Endpoint.String() != prev.String() {
+		return false
+	}
+	moved := *p
+	moved.Endpoint = endpoint
+	r.peers[id] = &moved
+	return true
+}
+
+func newRegistry() *registry {
+	return &registry{
+		peers: make(shared.Peers),
+		m:     &sync.Mutex{},
+	}
+}
+
+func toEndpoint(addr net.Addr) (shared.Endpoint, error) {
+	endpoint := strings.Split(addr.String(), ":")
+	if len(endpoint) != 2 {
+		return shared.Endpoint{}, errors.New("address is not valid")
+	}
+
+	port, err := strconv.Atoi(endpoint[1])
+	if err != nil {
+		return shared.Endpoint{}, err
+	}
+
+	return shared.Endpoint{
+		IP:   endpoint[0],
+		Port: port,
+	}, nil
+}
+
+// requester returns the registered peer a request comes from
+func requester(peers *registry, c shared.Conn, m *shared.Message) (*shared.Peer, error) {
 	// make sure requesting peer has registered with server
-	rp, ok := peers[m.PeerID]
+	rp, ok := peers.get(m.PeerID)
 	if !ok {
-		return nil, errors.New("client is not registered with this server")
+		return nil, shared.NewProtocolError(shared.NotRegistered, "client is not registered with this server")
+	}
+
+	// make sure the request comes from the registered peer itself
+	if !m.WasEncrypted() || c.GetAddr().String() != rp.Endpoint.String() {
+		return nil, shared.NewProtocolError(shared.Unauthorized, "%s request must be sent by the registered client", m.Type)
+	}
+	return rp, nil
+}
+
+// facilitate in the establishing of the p2p connection
+func establishHandler(peers *registry, cl *clocks, srv shared.Server, c shared.Conn, m *shared.Message) (*shared.Message, error) {
+	rp, err := requester(peers, c, m)
+	if err != nil {
+		return nil, err
 	}
 
 	// make sure that a valid payload was sent
 	id, ok := m.Content.(string)
 	if !ok {
-		return nil, errors.New("request content is malformed")
+		return nil, shared.NewProtocolError(shared.Malformed, "request content is malformed")
 	}
 
 	// make sure the other peer has registered with the server
-	op, ok := peers[id]
+	op, ok := peers.get(id)
 	if !ok {
-		return nil, fmt.Errorf("The peer: %s has not registered with the server.", id)
+		return nil, shared.NewProtocolError(shared.PeerNotFound, "The peer: %s has not registered with the server.", id).Detail("peerID", id)
 	}
 
 	// get conn for other peer
-	conn, ok := conns[op.Endpoint.String()]
+	conn, ok := srv.Conn(op.Endpoint.String())
 	if !ok {
-		return nil, fmt.Errorf("Could not resolve the peer: %s's conn", id)
+		return nil, shared.NewProtocolError(shared.PeerNotFound, "Could not resolve the peer: %s's conn", id).Detail("peerID", id)
 	}
 
+	rAt, oAt := cl.punchAt(rp.ID, op.ID)
+
 	// send requesting peer's endpoint to other peer
 	conn.Send(&shared.Message{
 		Type:    "establish",
-		Content: rp,
+		Content: &shared.Introduction{Peer: *rp, PunchAt: oAt},
 		Encrypt: true,
 	})
 
 	// send requesting peer other peer's endpoint
 	return &shared.Message{
 		Type:    "establish",
-		Content: op,
+		Content: &shared.Introduction{Peer: *op, PunchAt: rAt},
 		Encrypt: true,
 	}, nil
 }
 
+// clock is the last reading of a client's clock
+type clock struct {
+	rtt time.Duration
+	// offset is how far the client's clock is ahead of the server's
+	offset time.Duration
+}
+
+// clocks keeps a reading of every client's clock so that the server can have
+// two peers start punching at the same moment
+type clocks struct {
+	// margin is added to the time the slower peer takes to reach
+	margin   time.Duration
+	readings map[string]*clock
+	m        *sync.Mutex
+}
+
+// probe sends the client the server's time, the client answers with its own
+func (cl *clocks) probe(c shared.Conn) {
+	if cl == nil {
+		return
+	}
+	err := c.Send(&shared.Message{
+		Type:    "clock",
+		Content: &shared.ClockSample{Server: time.Now().UnixMilli()},
+		Encrypt: true,
+	})
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// read records the reading a client answered a probe with
+func (cl *clocks) read(id string, sample *shared.ClockSample) error {
+	now := time.Now()
+	sent := time.UnixMilli(sample.Server)
+	if sample.Server <= 0 || sample.Client <= 0 || sent.After(now) {
+		return shared.NewProtocolError(shared.Malformed, "clock sample is not valid")
+	}
+
+	// the client read its clock about half way through the round trip
+	rtt := now.Sub(sent)
+	offset := time.UnixMilli(sample.Client).Sub(sent.Add(rtt / 2))
+
+	cl.m.Lock()
+	defer cl.m.Unlock()
+	cl.readings[id] = &clock{rtt: rtt, offset: offset}
+	return nil
+}
+
+// punchAt returns when two peers should start punching in unix milliseconds
+// on their own clocks, zeros when either clock has not been read. The moment
+// leaves the slower peer a whole round trip to receive its establish message.
+func (cl *clocks) punchAt(a, b string) (int64, int64) {
+	if cl == nil {
+		return 0, 0
+	}
+	cl.m.Lock()
+	ca, okA := cl.readings[a]
+	cb, okB := cl.readings[b]
+	cl.m.Unlock()
+	if !okA || !okB {
+		return 0, 0
+	}
+
+	rtt := ca.rtt
+	if cb.rtt > rtt {
+		rtt = cb.rtt
+	}
+	at := time.Now().Add(rtt + cl.margin)
+	return at.Add(ca.offset).UnixMilli(), at.Add(cb.offset).UnixMilli()
+}
+
+func newClocks(margin time.Duration) *clocks {
+	return &clocks{
+		margin:   margin,
+		readings: make(map[string]*clock),
+		m:        &sync.Mutex{},
+	}
+}
+
+// clockHandler records the client's answer to a probe of its clock
+func clockHandler(peers *registry, cl *clocks, c shared.Conn, m *shared.Message) (*shared.Message, error) {
+	rp, err := requester(peers, c, m)
+	if err != nil {
+		return nil, err
+	}
+	if cl == nil {
+		return nil, shared.NewProtocolError(shared.UnsupportedType, "this server does not synchronize punching")
+	}
+
+	var sample shared.ClockSample
+	err = mapstructure.Decode(m.Content, &sample)
+	if err != nil {
+		return nil, shared.NewProtocolError(shared.Malformed, "clock sample is malformed")
+	}
+	return nil, cl.read(rp.ID, &sample)
+}
+
+// room is the membership of a room, members are kept by ID so that they
+// follow the peers when they register again
+type room struct {
+	epoch   uint64
+	members []string
+}
+
+// rooms is every open room by ID. The room handlers hold m while they run
+// as they change both the map and the rooms in it.
+type rooms struct {
+	rooms map[string]*room
+	m     *sync.Mutex
+}
+
+func newRooms() *rooms {
+	return &rooms{
+		rooms: make(map[string]*room),
+		m:     &sync.Mutex{},
+	}
+}
+
+func (r *room) has(id string) bool {
+	for _, m := range r.members {
+		if m == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *room) info(peers *registry, id string) *shared.RoomInfo {
+	info := &shared.RoomInfo{ID: id, Epoch: r.epoch}
+	for _, m := range r.members {
+		if p, ok := peers.get(m); ok {
+			info.Members = append(info.Members, p)
+		}
+	}
+	return info
+}
+
+// roomRequest returns the requesting peer and the room it names
+func roomRequest(peers *registry, rs *rooms, c shared.Conn, m *shared.Message) (*shared.Peer, string, *room, error) {
+	rp, err := requester(peers, c, m)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	id, ok := m.Content.(string)
+	if !ok {
+		return nil, "", nil, shared.NewProtocolError(shared.Malformed, "request content is malformed")
+	}
+
+	r, ok := rs.rooms[id]
+	if !ok {
+		return nil, "", nil, shared.NewProtocolError(shared.RoomNotFound, "The room: %s does not exist.", id).Detail("roomID", id)
+	}
+	return rp, id, r, nil
+}
+
+// notifyRoom sends the member list of the room to every member except the
+// peer with the ID except
+func notifyRoom(srv shared.Server, info *shared.RoomInfo, except string) {
+	for _, p := range info.Members {
+		if p.ID == except {
+			continue
+		}
+		conn, ok := srv.Conn(p.Endpoint.String())
+		if !ok {
+			log.Printf("Could not resolve the peer: %s's conn", p.ID)
+			continue
+		}
+		conn.Send(&shared.Message{
+			Type:    "room",
+			Content: info,
+			Encrypt: true,
+		})
+	}
+}
+
+// introduce sends two peers each other's endpoint so that they punch a
+// connection
+func introduce(cl *clocks, srv shared.Server, a, b *shared.Peer) {
+	aAt, bAt := cl.punchAt(a.ID, b.ID)
+	for _, pair := range []struct {
+		to, peer *shared.Peer
+		at       int64
+	}{{a, b, aAt}, {b, a, bAt}} {
+		conn, ok := srv.Conn(pair.to.Endpoint.String())
+		if !ok {
+			log.Printf("Could not resolve the peer: %s's conn", pair.to.ID)
+			continue
+		}
+		conn.Send(&shared.Message{
+			Type:    "establish",
+			Content: &shared.Introduction{Peer: *pair.peer, PunchAt: pair.at},
+			Encrypt: true,
+		})
+	}
+}
+
+// createRoomHandler opens a room with the requesting peer as its only member
+func createRoomHandler(peers *registry, rs *rooms, c shared.Conn, m *shared.Message) (*shared.Message, error) {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+
+	rp, err := requester(peers, c, m)
+	if err != nil {
+		return nil, err
+	}
+
+	id := shared.GenMessageID()
+	r := &room{epoch: 1, members: []string{rp.ID}}
+	rs.rooms[id] = r
+	log.Printf("Peer %s created room %s", rp.ID, id)
+
+	return &shared.Message{
+		Type:    "room",
+		Content: r.info(peers, id),
+		Encrypt: true,
+	}, nil
+}
+
+// joinRoomHandler adds the requesting peer to a room and introduces it to
+// every other member, the members punch pairwise connections between them
+func joinRoomHandler(peers *registry, rs *rooms, cl *clocks, srv shared.Server, c shared.Conn, m *shared.Message) (*shared.Message, error) {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+
+	rp, id, r, err := roomRequest(peers, rs, c, m)
+	if err != nil {
+		return nil, err
+	}
+
+	if !r.has(rp.ID) {
+		r.members = append(r.members, rp.ID)
+		r.epoch += 1
+		log.Printf("Peer %s joined room %s", rp.ID, id)
+
+		for _, member := range r.members {
+			if p, ok := peers.get(member); ok && member != rp.ID {
+				introduce(cl, srv, rp, p)
+			}
+		}
+	}
+
+	info := r.info(peers, id)
+	notifyRoom(srv, info, rp.ID)
+	return &shared.Message{
+		Type:    "room",
+		Content: info,
+		Encrypt: true,
+	}, nil
+}
+
+// leaveRoomHandler takes the requesting peer out of a room, the room is
+// closed once its last member has left
+func leaveRoomHandler(peers *registry, rs *rooms, srv shared.Server, c shared.Conn, m *shared.Message) (*shared.Message, error) {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+
+	rp, id, r, err := roomRequest(peers, rs, c, m)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.has(rp.ID) {
+		for i, member := range r.members {
+			if member == rp.ID {
+				r.members = append(r.members[:i], r.members[i+1:]...)
+				break
+			}
+		}
+		r.epoch += 1
+		log.Printf("Peer %s left room %s", rp.ID, id)
+	}
+
+	info := r.info(peers, id)
+	if len(r.members) == 0 {
+		delete(rs.rooms, id)
+	} else {
+		notifyRoom(srv, info, "")
+	}
+
+	// the member list without the peer tells it that it has left
+	return &shared.Message{
+		Type:    "room",
+		Content: info,
+		Encrypt: true,
+	}, nil
+}
+
+// roomHandler sends a member the member list of its room
+func roomHandler(peers *registry, rs *rooms, c shared.Conn, m *shared.Message) (*shared.Message, error) {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+
+	rp, id, r, err := roomRequest(peers, rs, c, m)
+	if err != nil {
+		return nil, err
+	}
+	if !r.has(rp.ID) {
+		return nil, shared.NewProtocolError(shared.NotMember, "The peer: %s is not a member of room %s.", rp.ID, id).Detail("roomID", id)
+	}
+
+	return &shared.Message{
+		Type:    "room",
+		Content: r.info(peers, id),
+		Encrypt: true,
+	}, nil
+}
+
+// mailbox keeps sealed mail for peers that are offline until they register
+// and acknowledge it, within a quota per recipient
+type mailbox struct {
+	ttl   time.Duration
+	count int
+	bytes int
+	mail  map[string][]*shared.Mail
+	m     *sync.Mutex
+}
+
+// purge drops the mail that has expired, b.m must be held
+func (b *mailbox) purge(now time.Time) {
+	for id, mails := range b.mail {
+		kept := mails[:0]
+		for _, mail := range mails {
+			if now.Unix() < mail.Expires {
+				kept = append(kept, mail)
+			}
+		}
+		if len(kept) == 0 {
+			delete(b.mail, id)
+		} else {
+			b.mail[id] = kept
+		}
+	}
+}
+
+// deposit stores mail for its recipient
+func (b *mailbox) deposit(mail *shared.Mail) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	now := time.Now()
+	b.purge(now)
+
+	size := len(mail.Sealed)
+	if size > shared.MaxMailSize {
+		return shared.NewProtocolError(shared.TooLarge, "mail must not be larger than %d bytes", shared.MaxMailSize)
+	}
+	mails := b.mail[mail.To]
+	for _, m := range mails {
+		size += len(m.Sealed)
+	}
+	if len(mails) >= b.count || size > b.bytes {
+		err := shared.NewProtocolError(shared.MailboxFull, "The mailbox of peer: %s is full.", mail.To).Detail("peerID", mail.To)
+		// room is made when the oldest mail expires
+		if len(mails) > 0 {
+			err.RetryAfter = time.Unix(mails[0].Expires, 0).Sub(now)
+		}
+		return err
+	}
+
+	mail.ID = shared.GenMessageID()
+	mail.Expires = now.Add(b.ttl).Unix()
+	b.mail[mail.To] = append(mails, mail)
+	return nil
+}
+
+// pending returns the mail kept for the peer
+func (b *mailbox) pending(id string) []*shared.Mail {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.purge(time.Now())
+	return append([]*shared.Mail(nil), b.mail[id]...)
+}
+
+// ack deletes the mail with the IDs from the peer's mailbox
+func (b *mailbox) ack(id string, ids []string) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	acked := make(map[string]bool, len(ids))
+	for _, i := range ids {
+		acked[i] = true
+	}
+	kept := b.mail[id][:0]
+	for _, mail := range b.mail[id] {
+		if !acked[mail.ID] {
+			kept = append(kept, mail)
+		}
+	}
+	if len(kept) == 0 {
+		delete(b.mail, id)
+	} else {
+		b.mail[id] = kept
+	}
+}
+
+func newMailbox(ttl time.Duration, count, bytes int) *mailbox {
+	return &mailbox{
+		ttl:   ttl,
+		count: count,
+		bytes: bytes,
+		mail:  make(map[string][]*shared.Mail),
+		m:     &sync.Mutex{},
+	}
+}
+
+// deliverMail sends a peer that has registered the mail kept for it, mail
+// that is not acknowledged is sent again when the peer next registers
+func deliverMail(box *mailbox, c shared.Conn, id string) {
+	if box == nil {
+		return
+	}
+	mails := box.pending(id)
+	if len(mails) == 0 {
+		return
+	}
+	err := c.Send(&shared.Message{
+		Type:    "mailbox",
+		Content: mails,
+		Encrypt: true,
+	})
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// mailHandler keeps mail the requesting peer leaves for another peer
+func mailHandler(peers *registry, box *mailbox, c shared.Conn, m *shared.Message) (*shared.Message, error) {
+	if box == nil {
+		return nil, shared.NewProtocolError(shared.UnsupportedType, "this server does not keep mail")
+	}
+	rp, err := requester(peers, c, m)
+	if err != nil {
+		return nil, err
+	}
+
+	var mail shared.Mail
+	err = mapstructure.Decode(m.Content, &mail)
+	if err != nil || mail.To == "" || mail.Sealed == "" {
+		return nil, shared.NewProtocolError(shared.Malformed, "request content is malformed")
+	}
+	// the recipient checks the sender's key, the server only makes sure
+	// that a peer can not fill a mailbox in another peer's name
+	if mail.From != rp.ID {
+		return nil, shared.NewProtocolError(shared.Unauthorized, "mail must be sent by its sender")
+	}
+
+	err = box.deposit(&mail)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Peer %s left mail %s for %s", rp.ID, mail.ID, mail.To)
+
+	return &shared.Message{
+		Type:    "mail",
+		Content: &mail,
+		Encrypt: true,
+	}, nil
+}
+
+// mailAckHandler deletes the mail the requesting peer has received
+func mailAckHandler(peers *registry, box *mailbox, c shared.Conn, m *shared.Message) (*shared.Message, error) {
+	if box == nil {
+		return nil, shared.NewProtocolError(shared.UnsupportedType, "this server does not keep mail")
+	}
+	rp, err := requester(peers, c, m)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	err = mapstructure.Decode(m.Content, &ids)
+	if err != nil {
+		return nil, shared.NewProtocolError(shared.Malformed, "request content is malformed")
+	}
+	box.ack(rp.ID, ids)
+	return nil, nil
+}
+
 func notFoundHandler(m *shared.Message) (*shared.Message, error) {
-	return nil, fmt.Errorf("Request type %s undefined", m.Type)
+	return nil, shared.NewProtocolError(shared.UnsupportedType, "Request type %s undefined", m.Type)
 }
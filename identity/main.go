@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/wilfreddenton/udp-hole-punching/shared"
+)
+
+const usage = `usage: identity <command> [-file path] [args]
+
+commands:
+  create           create a new identity
+  show             print the ID and public key of an identity
+  export <path>    write a copy of an identity encrypted with a new passphrase
+  import <path>    replace an identity with an exported one
+  rotate           replace an identity with a new key pair
+`
+
+func open(path string) *shared.IdentityStore {
+	pass, err := shared.ReadPassphrase("Passphrase for " + path + ": ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	return shared.NewIdentityStore(path, pass)
+}
+
+func newPassphrase(path string) []byte {
+	pass, err := shared.ReadPassphrase("New passphrase for " + path + ": ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	again, err := shared.ReadPassphrase("New passphrase for " + path + " (again): ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if string(pass) != string(again) {
+		log.Fatal("passphrases do not match")
+	}
+	return pass
+}
+
+func show(path string) {
+	id, err := shared.ReadIdentityID(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pub, err := shared.ReadIdentityPublicKey(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("ID: %s\nPublic key: %s\n", id, pub)
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		fmt.Print(usage)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	file := fs.String("file", "identity.key", "Path of the identity key file")
+	fs.Parse(os.Args[2:])
+
+	switch os.Args[1] {
+	case "create":
+		_, err := shared.NewIdentityStore(*file, newPassphrase(*file)).Create()
+		if err != nil {
+			log.Fatal(err)
+		}
+		show(*file)
+	case "show":
+		show(*file)
+	case "export":
+		if fs.NArg() != 1 {
+			log.Fatal("export needs the path to write the identity to")
+		}
+		kp, err := open(*file).Load()
+		if err != nil {
+			log.Fatal(err)
+		}
+		out := shared.NewIdentityStore(fs.Arg(0), newPassphrase(fs.Arg(0)))
+		if out.Exists() {
+			log.Fatalf("%s already exists", fs.Arg(0))
+		}
+		err = out.Save(kp)
+		if err != nil {
+			log.Fatal(err)
+		}
+		show(fs.Arg(0))
+	case "import":
+		if fs.NArg() != 1 {
+			log.Fatal("import needs the path of the exported identity")
+		}
+		kp, err := open(fs.Arg(0)).Load()
+		if err != nil {
+			log.Fatal(err)
+		}
+		// the identity being replaced is kept as .old
+		err = shared.NewIdentityStore(*file, newPassphrase(*file)).Replace(kp)
+		if err != nil {
+			log.Fatal(err)
+		}
+		show(*file)
+	case "rotate":
+		_, err := open(*file).Rotate()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("the previous identity was moved to %s.old\n", *file)
+		show(*file)
+	default:
+		fmt.Print(usage)
+		os.Exit(2)
+	}
+}
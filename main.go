@@ -1,47 +1,60 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net"
 
-	"github.com/wilfreddenton/crypto"
 	"github.com/wilfreddenton/udp-hole-punching/shared"
 	"github.com/wilfreddenton/udp-hole-punching/udp_server"
 )
 
-var (
-	pubKey [32]byte
-	priKey [32]byte
-)
+var keys *shared.KeyPair
 
-func route(peers shared.Peers, conns shared.Conns, conn shared.Conn, m *shared.Message) (*shared.Message, error) {
+func route(peers *registry, rs *rooms, box *mailbox, cl *clocks, srv shared.Server, conn shared.Conn, m *shared.Message) (*shared.Message, error) {
 	switch m.Type {
-	case "greeting":
-		return greetingHandler(conn, m)
+	case "handshake":
+		return handshakeHandler(conn, m)
 	case "register":
-		return registerHandler(peers, conn, m)
+		return registerHandler(peers, box, cl, conn, m)
 	case "establish":
-		return establishHandler(peers, conns, m)
+		return establishHandler(peers, cl, srv, conn, m)
+	case "create-room":
+		return createRoomHandler(peers, rs, conn, m)
+	case "join-room":
+		return joinRoomHandler(peers, rs, cl, srv, conn, m)
+	case "leave-room":
+		return leaveRoomHandler(peers, rs, srv, conn, m)
+	case "room":
+		return roomHandler(peers, rs, conn, m)
+	case "mail":
+		return mailHandler(peers, box, conn, m)
+	case "mail-ack":
+		return mailAckHandler(peers, box, conn, m)
+	case "clock":
+		return clockHandler(peers, cl, conn, m)
 	default:
 		return notFoundHandler(m)
 	}
 }
 
-func createMessageCallback(peers shared.Peers) func(cs shared.Conns, c shared.Conn, m *shared.Message) {
-	return func(cs shared.Conns, c shared.Conn, m *shared.Message) {
+func createMessageCallback(srv shared.Server, peers *registry, rs *rooms, box *mailbox, cl *clocks) func(c shared.Conn, m *shared.Message) {
+	return func(c shared.Conn, m *shared.Message) {
 		// log request
 		log.Printf("Request from client at %s over %s with type %s", c.GetAddr(), c.Protocol(), m.Type)
 
 		// route request to a handler
-		res, err := route(peers, cs, c, m)
+		res, err := route(peers, rs, box, cl, srv, c, m)
 
 		// respond with error if there was one
 		if err != nil {
-			c.Send(&shared.Message{
-				Type:  m.Type,
-				Error: err.Error(),
-			})
+			c.Send(shared.ErrorReply(m.Type, err))
+			return
+		}
+
+		// some requests do not need a response
+		if res == nil {
 			return
 		}
 
@@ -53,11 +66,27 @@ func createMessageCallback(peers shared.Peers) func(cs shared.Conns, c shared.Co
 	}
 }
 
+func createMigrateCallback(peers *registry) func(c shared.Conn, prev net.Addr) {
+	return func(c shared.Conn, prev net.Addr) {
+		err := migrateHandler(peers, c, prev)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
 func main() {
+	keepMail := flag.Bool("mailbox", false, "keep sealed mail for peers that are offline")
+	mailTTL := flag.Duration("mailTTL", shared.DefaultMailTTL, "how long mail is kept")
+	mailCount := flag.Int("mailCount", shared.DefaultMailCount, "how many messages are kept for a peer")
+	mailBytes := flag.Int("mailBytes", shared.DefaultMailBytes, "how many bytes of mail are kept for a peer")
+	punchMargin := flag.Duration("punchMargin", shared.DefaultPunchMargin, "how long after both peers can be reached they start punching (0 lets them start right away)")
+	flag.Parse()
+
 	fmt.Println("UDP Hole Punching Rendezvous Server v0.0.1")
 
 	var err error
-	priKey, pubKey, err = crypto.GenKeyPair()
+	keys, err = shared.GenKeyPair()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -72,7 +101,20 @@ func main() {
 		log.Fatal(err)
 	}
 
-	udpPeers := make(shared.Peers)
-	udpS.OnMessage(createMessageCallback(udpPeers))
+	// the mailbox is off unless asked for
+	var box *mailbox
+	if *keepMail {
+		box = newMailbox(*mailTTL, *mailCount, *mailBytes)
+	}
+
+	// peers start punching at a time the server picks unless turned off
+	var cl *clocks
+	if *punchMargin > 0 {
+		cl = newClocks(*punchMargin)
+	}
+
+	udpPeers := newRegistry()
+	udpS.OnMessage(createMessageCallback(udpS, udpPeers, newRooms(), box, cl))
+	udpS.OnMigrate(createMigrateCallback(udpPeers))
 	udpS.Listen()
 }
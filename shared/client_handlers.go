@@ -5,61 +5,135 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/mitchellh/mapstructure"
-	"github.com/wilfreddenton/crypto"
 )
 
-func greetingHandler(c Client, serverConn Conn, m *Message) (*Message, error) {
+// handshakeHandler runs the Noise handshake with both the rendezvous server
+// and the peer
+func handshakeHandler(c Client, conn Conn, m *Message) (*Message, error) {
 	l := c.GetLog()
 	self := c.GetSelf()
-	// quit the client if greeting fails
-	if m.Error != "" {
-		l.Fatal(m.Error)
-		return nil, errors.New(m.Error)
+	// the client can not go on without the server
+	if m.Error != "" && conn == c.GetServerConn() {
+		return nil, fatalError(fmt.Errorf("the rendezvous server refused the handshake: %w", MessageError(m)))
 	}
 
-	// ensure that server sent back a public key string
-	s, ok := m.Content.(string)
-	if !ok {
-		return nil, errors.New("expected to receive public key with greeting")
+	var hm HandshakeMessage
+	err := mapstructure.Decode(m.Content, &hm)
+	if err != nil {
+		return nil, NewProtocolError(Malformed, "handshake message is malformed")
 	}
 
-	// get server public key
-	bs, err := base64.StdEncoding.DecodeString(s)
+	kp, err := self.GetKeyPair()
 	if err != nil {
 		return nil, err
 	}
-	var pubKey [32]byte
-	copy(pubKey[:], bs)
 
-	// get self public keySent
-	sPubKey, err := self.GetPublicKey()
+	if conn == c.GetServerConn() {
+		reply, complete, err := HandleHandshake(conn, kp, &hm)
+		if err != nil {
+			return nil, err
+		}
+		if !complete {
+			return handshakeReply(self, reply), nil
+		}
+
+		// the server conn does not need rekeying as it only carries signalling
+		h := conn.GetHandshake()
+		conn.SetCipher(NewRatchet(h.Root(), h.Initiator()))
+		conn.Send(handshakeReply(self, reply))
+
+		// send register message to server
+		return RegisterMessage(self), nil
+	}
+
+	// the peer may start the handshake before the server's establish message
+	// has arrived, ignore it as the message will be sent again
+	s, ok := c.GetSessions().ByConn(conn)
+	if !ok {
+		l.Printf("ignoring handshake message from unknown peer at %s", conn.GetAddr())
+		return nil, nil
+	}
+
+	reply, complete, err := HandleHandshake(conn, kp, &hm)
 	if err != nil {
 		return nil, err
 	}
+	if !complete {
+		return handshakeReply(self, reply), nil
+	}
+
+	h := conn.GetHandshake()
+	pubKey := h.RemoteStatic()
+
+	// the peer's ID is the hash of its public key so a key that does not hash
+	// to the ID the session was opened for belongs to someone else: likely a
+	// man in the middle
+	peer := s.GetPeer()
+	if id := GenID(pubKey); id != peer.ID {
+		return nil, sessionError(fmt.Errorf("SECURITY ERROR: peer at %s presented a key for ID %s but ID %s was expected, aborting", conn.GetAddr(), id, peer.ID))
+	}
+
+	// install the transport keys
+	conn.SetCipher(NewRotatingCipher(NewRatchet(h.Root(), h.Initiator()), c.GetRekeyPolicy()))
+
+	// derive the short authentication string the users can compare
+	hash := h.Hash()
+	s.SetSAS(GenSAS(kp.Public, pubKey, hash[:]))
+	s.SetReady()
 
-	// create and store secret
-	serverConn.SetSecret(crypto.GenSharedSecret(self.PrivateKey, pubKey))
+	l.Printf("completed handshake with peer %s at %s", peer.Username, conn.GetAddr())
+	return handshakeReply(self, reply), nil
+}
 
-	// send register message to server
+// RegisterMessage returns the message that registers self with the
+// rendezvous server once the handshake is complete
+func RegisterMessage(self *Peer) *Message {
 	return &Message{
 		Type:   "register",
 		PeerID: self.ID,
 		Content: Registration{
 			Username:  self.Username,
-			PublicKey: base64.StdEncoding.EncodeToString(sPubKey[:]),
+			PublicKey: self.PublicKey,
 		},
-	}, nil
+		Encrypt: true,
+	}
+}
+
+func handshakeReply(self *Peer, hm *HandshakeMessage) *Message {
+	if hm == nil {
+		return nil
+	}
+	return &Message{
+		Type:    "handshake",
+		PeerID:  self.ID,
+		Content: hm,
+	}
 }
 
 func registerHandler(c Client, serverConn Conn, m *Message) (*Message, error) {
 	// quit the client if registration fails
 	if m.Error != "" {
-		return nil, errors.New(m.Error)
+		return nil, fatalError(fmt.Errorf("the rendezvous server refused to register the client: %w", MessageError(m)))
+	}
+
+	var e Endpoint
+	err := mapstructure.Decode(m.Content, &e)
+	if err != nil {
+		return nil, err
 	}
 
-	c.RegisteredCallback(c)
+	// the client registers again periodically, only the first registration
+	// is reported
+	prev := c.GetEndpoint()
+	c.SetEndpoint(e)
+	if prev == (Endpoint{}) {
+		c.RegisteredCallback(c)
+	} else if prev != e {
+		c.GetLog().Printf("public endpoint moved from %s to %s", prev, e)
+	}
 	return nil, nil
 }
 
@@ -67,19 +141,30 @@ func establishHandler(c Client, serverConn Conn, m *Message) (*Message, error) {
 	l := c.GetLog()
 	l.Print("establish request from server")
 	if m.Error != "" {
-		return nil, errors.New(m.Error)
+		return nil, MessageError(m)
 	}
 
-	var p Peer
-	err := mapstructure.Decode(m.Content, &p)
+	var in Introduction
+	err := mapstructure.Decode(m.Content, &in)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
-	c.SetPeer(&Peer{
-		ID:       p.ID,
-		Username: p.Username,
-	})
+	p := in.Peer
+
+	// the server introduces both the peers the user dialed and the peers that
+	// dialed the user. Either way the peer has to prove it owns p.ID during
+	// the handshake.
+	if _, ok := c.GetSessions().Get(p.ID); ok {
+		l.Printf("ignoring establish request because the client is already connected to peer %s", p.ID)
+		return nil, nil
+	}
+	// the key is checked against the ID by the handshake, it lets the
+	// client leave mail for the peer later
+	peer := &Peer{
+		ID:        p.ID,
+		Username:  p.Username,
+		PublicKey: p.PublicKey,
+	}
 
 	var addr net.Addr
 	switch serverConn.Protocol() {
@@ -94,9 +179,9 @@ func establishHandler(c Client, serverConn Conn, m *Message) (*Message, error) {
 		return nil, err
 	}
 
-	if c.GetPeerConn() != nil && c.GetPeerConn().GetAddr().String() != addr.String() {
-		l.Print("ignoring establish request because the client is already connected to a peer")
-		return nil, nil
+	kp, err := c.GetSelf().GetKeyPair()
+	if err != nil {
+		return nil, err
 	}
 
 	go func() {
@@ -105,11 +190,28 @@ func establishHandler(c Client, serverConn Conn, m *Message) (*Message, error) {
 			return
 		}
 
-		c.SetPeerConn(pConn)
+		// both peers punch but only the one with the lower ID starts the
+		// handshake, the other answers it
+		if c.GetSelf().ID < p.ID {
+			pConn.SetHandshake(NewHandshake(true, kp))
+		}
+
+		s := NewSession(peer, pConn, c.Dialed(p.ID))
+		// the peer can not be reached any more once a reliable message is
+		// given up on
+		pConn.GetReliable().OnFail(func(m *Message, err error) {
+			handleError(c, pConn, m, sessionError(err))
+		})
+		if in.PunchAt > 0 {
+			s.SetPunchAt(time.UnixMilli(in.PunchAt))
+		}
+		if !c.GetSessions().Add(s) {
+			return
+		}
 
-		go c.Connect()
+		go c.Connect(c.Context(), s)
 
-		c.ConnectingCallback(c)
+		c.ConnectingCallback(c, s)
 	}()
 	return nil, nil
 }
@@ -118,80 +220,591 @@ func connectHandler(c Client, peerConn Conn, m *Message) (*Message, error) {
 	self := c.GetSelf()
 	l := c.GetLog()
 
-	pConn := c.GetPeerConn()
-	if pConn == nil {
+	// punches are not encrypted so they can not be matched to a session that
+	// has moved, the encrypted messages that follow will find it
+	s, ok := c.GetSessions().ByConn(peerConn)
+	if !ok {
+		l.Printf("ignoring connect message from unknown peer at %s", peerConn.GetAddr())
 		return nil, nil
 	}
 
-	if pConn != peerConn {
-		// if addresses are the same then this is the correct peer but the listener has picked up the message and created a new conn
-		if pConn.GetAddr().String() == peerConn.GetAddr().String() {
-			pConn = peerConn
-			c.SetPeerConn(pConn)
-		}
-		return nil, errors.New("received connect message from unknown peer")
+	l.Printf("connection mirror request from peer %s at %s", s.GetPeer().Username, peerConn.GetAddr())
+
+	// the peer's punch got through so answer with the pending handshake
+	// message right away instead of waiting for the next attempt
+	h := peerConn.GetHandshake()
+	if h == nil || h.Complete() {
+		return nil, nil
 	}
+	hm, err := h.Next()
+	if err != nil {
+		return nil, err
+	}
+	return handshakeReply(self, hm), nil
+}
 
-	l.Printf("connection mirror request from peer %s at %s, sending mirror...", self.Username, pConn.GetAddr())
+func rekeyHandler(c Client, peerConn Conn, m *Message) (*Message, error) {
+	l := c.GetLog()
+	s, ok := c.GetSessions().ByConn(peerConn)
+	if !ok {
+		return nil, errors.New("received rekey message from unknown peer")
+	}
+	if !m.WasEncrypted() {
+		return nil, NewProtocolError(Unauthorized, "rekey messages must be encrypted")
+	}
 
-	pubKey, err := self.GetPublicKey()
+	var r Rekey
+	err := mapstructure.Decode(m.Content, &r)
 	if err != nil {
 		return nil, err
 	}
 
-	// confirm public key was sent to peer
-	defer c.SetKeySent(true)
+	cipher, err := peerConn.GetCipher()
+	if err != nil {
+		return nil, err
+	}
+	rc, ok := cipher.(*RotatingCipher)
+	if !ok {
+		return nil, errors.New("peer connection does not support rekeying")
+	}
+
+	// the two ends can not agree on keys anymore
+	res, err := rc.HandleRekey(&r)
+	if err != nil {
+		return nil, sessionError(err)
+	}
+	if res == nil {
+		return nil, nil
+	}
 
+	l.Printf("rekeying session with peer %s to epoch %d", s.GetPeer().Username, res.Epoch)
 	return &Message{
-		Type:    "key",
-		PeerID:  self.ID,
-		Content: base64.StdEncoding.EncodeToString(pubKey[:]),
+		Type:    "rekey",
+		PeerID:  c.GetSelf().ID,
+		Content: res,
+		Encrypt: true,
 	}, nil
 }
 
-func keyHandler(c Client, peerConn Conn, m *Message) (*Message, error) {
+// pingHandler answers keepalives, any authenticated message counts as a
+// sign of life so pongs need no handler
+func pingHandler(c Client, peerConn Conn, m *Message) (*Message, error) {
+	_, ok := c.GetSessions().ByConn(peerConn)
+	if !ok {
+		return nil, errors.New("received ping message from unknown peer")
+	}
+	if !m.WasEncrypted() {
+		return nil, NewProtocolError(Unauthorized, "ping messages must be encrypted")
+	}
+
+	return &Message{
+		Type:    "pong",
+		PeerID:  c.GetSelf().ID,
+		Encrypt: true,
+	}, nil
+}
+
+// clockHandler answers the server's reading of its clock with the client's so
+// that the server can tell how far away the client is and how its clock is
+// off
+func clockHandler(c Client, serverConn Conn, m *Message) (*Message, error) {
+	if serverConn != c.GetServerConn() || !m.WasEncrypted() {
+		return nil, NewProtocolError(Unauthorized, "clock messages must be sent encrypted by the server")
+	}
+
+	var sample ClockSample
+	err := mapstructure.Decode(m.Content, &sample)
+	if err != nil {
+		return nil, NewProtocolError(Malformed, "clock sample is malformed")
+	}
+	sample.Client = time.Now().UnixMilli()
+
+	return &Message{
+		Type:    "clock",
+		PeerID:  c.GetSelf().ID,
+		Content: &sample,
+		Encrypt: true,
+	}, nil
+}
+
+func disconnectHandler(c Client, peerConn Conn, m *Message) (*Message, error) {
+	if !m.WasEncrypted() {
+		return nil, NewProtocolError(Unauthorized, "disconnect messages must be encrypted")
+	}
+
+	var d Disconnect
+	err := mapstructure.Decode(m.Content, &d)
+	if err != nil {
+		return nil, err
+	}
+
+	// the session may have already ended on this side
+	s, ok := c.GetSessions().ByConn(peerConn)
+	if !ok {
+		return nil, nil
+	}
+
+	peer := s.GetPeer()
+	if c.EndSession(s) {
+		c.GetLog().Printf("peer %s disconnected: %s", peer.Username, d.Reason)
+		c.DisconnectedCallback(c, s, fmt.Sprintf("%s disconnected: %s", peer.Username, d.Reason))
+	}
+	return nil, nil
+}
+
+func messageHandler(c Client, peerConn Conn, m *Message) (*Message, error) {
+	s, ok := c.GetSessions().ByConn(peerConn)
+	if !ok {
+		return nil, errors.New("received message message from unknown peer")
+	}
+	if !m.WasEncrypted() {
+		return nil, NewProtocolError(Unauthorized, "message messages must be encrypted")
+	}
+
+	var chat Chat
+	err := mapstructure.Decode(m.Content, &chat)
+	if err != nil || chat.ID == "" {
+		return nil, NewProtocolError(Malformed, "message message must send an ID and some text in content field")
+	}
+
+	c.MessageCallback(c, s, &chat)
+
+	// let the sender know the message arrived
+	return &Message{
+		Type:     "receipt",
+		PeerID:   c.GetSelf().ID,
+		Content:  Receipt{ID: chat.ID, State: Delivered},
+		Encrypt:  true,
+		Reliable: true,
+	}, nil
+}
+
+func receiptHandler(c Client, peerConn Conn, m *Message) (*Message, error) {
+	s, ok := c.GetSessions().ByConn(peerConn)
+	if !ok {
+		return nil, errors.New("received receipt message from unknown peer")
+	}
+	if !m.WasEncrypted() {
+		return nil, NewProtocolError(Unauthorized, "receipt messages must be encrypted")
+	}
+
+	var r Receipt
+	err := mapstructure.Decode(m.Content, &r)
+	if err != nil {
+		return nil, err
+	}
+	if r.State != Delivered && r.State != Read {
+		return nil, NewProtocolError(Malformed, "unknown receipt state %s", r.State)
+	}
+
+	c.ReceiptCallback(c, s, &r)
+	return nil, nil
+}
+
+func signalHandler(c Client, peerConn Conn, m *Message) (*Message, error) {
+	s, ok := c.GetSessions().ByConn(peerConn)
+	if !ok {
+		return nil, errors.New("received signal message from unknown peer")
+	}
+	if !m.WasEncrypted() {
+		return nil, NewProtocolError(Unauthorized, "signal messages must be encrypted")
+	}
+
+	var sig Signal
+	err := mapstructure.Decode(m.Content, &sig)
+	if err != nil || sig.Name == "" {
+		return nil, NewProtocolError(Malformed, "signal message must send a name in content field")
+	}
+
+	c.PeerSignalCallback(c, s, &sig)
+	return nil, nil
+}
+
+func offerHandler(c Client, peerConn Conn, m *Message) (*Message, error) {
+	s, ok := c.GetSessions().ByConn(peerConn)
+	if !ok {
+		return nil, errors.New("received offer message from unknown peer")
+	}
+	if !m.WasEncrypted() {
+		return nil, NewProtocolError(Unauthorized, "offer messages must be encrypted")
+	}
+
+	var o FileOffer
+	err := mapstructure.Decode(m.Content, &o)
+	if err != nil {
+		return nil, err
+	}
+
+	t, resume, err := c.GetTransfers().Receive(&o, s.GetPeer().ID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case t.Complete:
+		// the earlier final ack was lost
+		return fileAckMessage(c, &FileAck{ID: t.ID, Offset: t.Size, Complete: true}), nil
+	case resume:
+		c.GetLog().Printf("resuming download of %s", t.Name)
+		return nil, c.AcceptFile(t.PeerID, t.ID)
+	}
+
+	c.FileOfferCallback(c, s, t)
+	return nil, nil
+}
+
+func acceptHandler(c Client, peerConn Conn, m *Message) (*Message, error) {
 	l := c.GetLog()
-	pConn := c.GetPeerConn()
-	if pConn != peerConn {
-		return nil, errors.New("received key message from unknown peer")
+	s, ok := c.GetSessions().ByConn(peerConn)
+	if !ok {
+		return nil, errors.New("received accept message from unknown peer")
+	}
+	if !m.WasEncrypted() {
+		return nil, NewProtocolError(Unauthorized, "accept messages must be encrypted")
+	}
+
+	var a FileAccept
+	err := mapstructure.Decode(m.Content, &a)
+	if err != nil {
+		return nil, err
 	}
 
-	// ensure that public key was sent with message
-	s, ok := m.Content.(string)
+	ts := c.GetTransfers()
+	t, run, err := ts.Start(s.GetPeer().ID, &a)
+	if err != nil {
+		return nil, err
+	}
+	c.FileProgressCallback(c, s, t)
+
+	// chunks wait for room in the reliable layer so send them from their own
+	// goroutine
+	go func() {
+		err := ts.Send(t.PeerID, t.ID, run, a.Offset, func(fc *FileChunk) error {
+			return peerConn.Send(&Message{
+				Type:     "chunk",
+				PeerID:   c.GetSelf().ID,
+				Content:  fc,
+				Encrypt:  true,
+				Reliable: true,
+				Bulk:     true,
+			})
+		})
+		if err != nil {
+			l.Printf("could not send file %s: %s", t.Name, err)
+		}
+	}()
+	return nil, nil
+}
+
+func chunkHandler(c Client, peerConn Conn, m *Message) (*Message, error) {
+	s, ok := c.GetSessions().ByConn(peerConn)
 	if !ok {
-		return nil, errors.New("no public key was sent with key message")
+		return nil, errors.New("received chunk message from unknown peer")
+	}
+	if !m.WasEncrypted() {
+		return nil, NewProtocolError(Unauthorized, "chunk messages must be encrypted")
 	}
 
-	// decode and store the sent public key
-	bs, err := base64.StdEncoding.DecodeString(s)
+	var fc FileChunk
+	err := mapstructure.Decode(m.Content, &fc)
 	if err != nil {
 		return nil, err
 	}
 
-	var pubKey [32]byte
-	copy(pubKey[:], bs)
+	t, ack, err := c.GetTransfers().Write(s.GetPeer().ID, &fc)
+	if err != nil {
+		return nil, err
+	}
+	if ack == nil {
+		return nil, nil
+	}
 
-	// create and store cipher with other peer's public key
-	pConn.SetSecret(crypto.GenSharedSecret(c.GetSelf().PrivateKey, pubKey))
+	c.FileProgressCallback(c, s, t)
+	return fileAckMessage(c, ack), nil
+}
 
-	// confirm peer's public key was received
-	c.SetKeyReceived(true)
+func fileAckHandler(c Client, peerConn Conn, m *Message) (*Message, error) {
+	s, ok := c.GetSessions().ByConn(peerConn)
+	if !ok {
+		return nil, errors.New("received file-ack message from unknown peer")
+	}
+	if !m.WasEncrypted() {
+		return nil, NewProtocolError(Unauthorized, "file-ack messages must be encrypted")
+	}
+
+	var a FileAck
+	err := mapstructure.Decode(m.Content, &a)
+	if err != nil {
+		return nil, err
+	}
 
-	l.Printf("received communication mirror from peer %s at %s", c.GetPeer().Username, pConn.GetAddr())
+	t, err := c.GetTransfers().Acked(s.GetPeer().ID, &a)
+	if err != nil {
+		return nil, err
+	}
+
+	c.FileProgressCallback(c, s, t)
 	return nil, nil
 }
 
-func messageHandler(c Client, peerConn Conn, m *Message) (*Message, error) {
-	pConn := c.GetPeerConn()
-	if pConn != peerConn {
-		return nil, errors.New("received message message from unknown peer")
+func fileAckMessage(c Client, a *FileAck) *Message {
+	return &Message{
+		Type:     "file-ack",
+		PeerID:   c.GetSelf().ID,
+		Content:  a,
+		Encrypt:  true,
+		Reliable: true,
+	}
+}
+
+func streamHandler(c Client, peerConn Conn, m *Message) (*Message, error) {
+	_, ok := c.GetSessions().ByConn(peerConn)
+	if !ok {
+		return nil, errors.New("received stream message from unknown peer")
+	}
+	if !m.WasEncrypted() {
+		return nil, NewProtocolError(Unauthorized, "stream messages must be encrypted")
+	}
+
+	var f Frame
+	err := mapstructure.Decode(m.Content, &f)
+	if err != nil {
+		return nil, err
+	}
+
+	// a misbehaving stream only affects itself
+	err = peerConn.GetMux().Handle(&f)
+	if err != nil {
+		c.GetLog().Print(err)
+	}
+	return nil, nil
+}
+
+func datagramHandler(c Client, peerConn Conn, m *Message) (*Message, error) {
+	_, ok := c.GetSessions().ByConn(peerConn)
+	if !ok {
+		return nil, errors.New("received datagram message from unknown peer")
 	}
+	if !m.WasEncrypted() {
+		return nil, NewProtocolError(Unauthorized, "datagram messages must be encrypted")
+	}
+
 	text, ok := m.Content.(string)
 	if !ok {
-		return nil, errors.New("message message must send some text in content field")
+		return nil, NewProtocolError(Malformed, "datagram message must send base64 data in content field")
+	}
+	b, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return nil, err
+	}
+
+	peerConn.GetMux().HandleDatagram(b)
+	return nil, nil
+}
+
+// roomHandler applies the member list the rendezvous server sends whenever
+// the membership of a room the client is in changes
+func roomHandler(c Client, serverConn Conn, m *Message) (*Message, error) {
+	l := c.GetLog()
+	if serverConn != c.GetServerConn() {
+		l.Printf("ignoring room message from %s", serverConn.GetAddr())
+		return nil, nil
+	}
+	if m.Error != "" {
+		return nil, MessageError(m)
+	}
+
+	var info RoomInfo
+	err := mapstructure.Decode(m.Content, &info)
+	if err != nil || info.ID == "" {
+		return nil, NewProtocolError(Malformed, "room message must send a room in content field")
+	}
+
+	self := c.GetSelf().ID
+	member := false
+	for _, p := range info.Members {
+		member = member || p.ID == self
+	}
+
+	rooms := c.GetRooms()
+	if !member {
+		if r, ok := rooms.Get(info.ID); ok && rooms.Remove(r) {
+			l.Printf("left room %s", info.ID)
+			c.RoomCallback(c, r)
+		}
+		return nil, nil
+	}
+
+	r := rooms.GetOrAdd(info.ID, self)
+	applied, ready := r.Update(&info)
+	if !applied {
+		return nil, nil
+	}
+	l.Printf("room %s is at epoch %d with %d members", info.ID, info.Epoch, len(info.Members))
+	c.RoomCallback(c, r)
+
+	// the keeper rotates the group key with every change of membership
+	if r.Keeper() == self {
+		if _, err := r.NewKey(); err != nil {
+			return nil, err
+		}
+		for _, p := range r.GetMembers() {
+			c.ShareRoomKeys(p.ID)
+		}
+	}
+	deliverRoom(c, r, ready)
+	return nil, nil
+}
+
+// requestErrorHandler reports the requests the rendezvous server refused
+// whose answers have no handler of their own
+func requestErrorHandler(c Client, serverConn Conn, m *Message) (*Message, error) {
+	if m.Error != "" {
+		return nil, fmt.Errorf("%s request failed: %w", m.Type, MessageError(m))
+	}
+	return nil, nil
+}
+
+func roomKeyHandler(c Client, peerConn Conn, m *Message) (*Message, error) {
+	s, ok := c.GetSessions().ByConn(peerConn)
+	if !ok {
+		return nil, errors.New("received room-key message from unknown peer")
+	}
+	if !m.WasEncrypted() {
+		return nil, NewProtocolError(Unauthorized, "room-key messages must be encrypted")
+	}
+
+	var k RoomKey
+	err := mapstructure.Decode(m.Content, &k)
+	if err != nil {
+		return nil, err
+	}
+
+	r, ok := c.GetRooms().Get(k.RoomID)
+	if !ok {
+		c.GetLog().Printf("ignoring key of room %s the client is not in", k.RoomID)
+		return nil, nil
+	}
+	ready, err := r.SetKey(s.GetPeer().ID, &k)
+	if err != nil {
+		c.GetLog().Print(err)
+		return nil, nil
+	}
+	deliverRoom(c, r, ready)
+	return nil, nil
+}
+
+func roomMessageHandler(c Client, peerConn Conn, m *Message) (*Message, error) {
+	s, ok := c.GetSessions().ByConn(peerConn)
+	if !ok {
+		return nil, errors.New("received room-message message from unknown peer")
+	}
+	if !m.WasEncrypted() {
+		return nil, NewProtocolError(Unauthorized, "room-message messages must be encrypted")
+	}
+
+	var env RoomEnvelope
+	err := mapstructure.Decode(m.Content, &env)
+	if err != nil {
+		return nil, err
+	}
+
+	// only members may relay into a room
+	from := s.GetPeer().ID
+	r, ok := c.GetRooms().Get(env.RoomID)
+	if !ok {
+		return nil, nil
+	}
+	if _, ok := r.Member(from); !ok {
+		c.GetLog().Printf("ignoring message for room %s from %s who is not a member", env.RoomID, from)
+		return nil, nil
+	}
+
+	fresh, ready, err := r.Receive(&env)
+	if err != nil {
+		c.GetLog().Print(err)
+	}
+	if fresh {
+		err = r.FanOut(c.GetSessions(), &env, from)
+		if err != nil {
+			c.GetLog().Print(err)
+		}
+	}
+	deliverRoom(c, r, ready)
+	return nil, nil
+}
+
+// deliverRoom hands room messages to the user in the order the room delivered
+// them
+func deliverRoom(c Client, r *Room, ready []*RoomMessage) {
+	for _, msg := range ready {
+		p, ok := r.Member(msg.Sender)
+		if !ok {
+			continue
+		}
+		chat := msg.Chat
+		c.RoomMessageCallback(c, r, p, &chat)
+	}
+}
+
+// mailboxHandler opens the mail the rendezvous server kept for the client
+// while it was offline and acknowledges it so that the server deletes it
+func mailboxHandler(c Client, serverConn Conn, m *Message) (*Message, error) {
+	l := c.GetLog()
+	if serverConn != c.GetServerConn() {
+		l.Printf("ignoring mailbox message from %s", serverConn.GetAddr())
+		return nil, nil
+	}
+	if m.Error != "" {
+		return nil, MessageError(m)
 	}
 
-	c.MessageCallback(c, text)
-	// c.messageHook(c, s)
+	var mails []Mail
+	err := mapstructure.Decode(m.Content, &mails)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(mails))
+	for i := range mails {
+		mail := &mails[i]
+		// mail that can not be opened never will be so it is deleted too
+		ids = append(ids, mail.ID)
+		if c.GetInbox().Seen(mail) {
+			continue
+		}
+
+		peer, chat, sentAt, err := OpenMail(c.GetSelf(), mail)
+		if err != nil {
+			l.Printf("could not open mail %s from %s: %s", mail.ID, mail.From, err)
+			continue
+		}
+		c.MailCallback(c, peer, chat, sentAt)
+	}
+
+	return &Message{
+		Type:    "mail-ack",
+		PeerID:  c.GetSelf().ID,
+		Content: ids,
+		Encrypt: true,
+	}, nil
+}
+
+// mailHandler reports whether the rendezvous server stored mail the client
+// left for a peer
+func mailHandler(c Client, serverConn Conn, m *Message) (*Message, error) {
+	if serverConn != c.GetServerConn() {
+		return nil, nil
+	}
+	if m.Error != "" {
+		return nil, fmt.Errorf("could not leave mail: %w", MessageError(m))
+	}
+
+	var mail Mail
+	err := mapstructure.Decode(m.Content, &mail)
+	if err != nil {
+		return nil, err
+	}
+	c.GetLog().Printf("left mail %s for %s until %s", mail.ID, mail.To, time.Unix(mail.Expires, 0).Format(time.RFC3339))
 	return nil, nil
 }
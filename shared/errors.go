@@ -0,0 +1,248 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrorCode names the reason for an error reply so that programs do not have
+// to match its text
+type ErrorCode string
+
+const (
+	// PeerNotFound means the peer a request names is not registered
+	PeerNotFound ErrorCode = "peer_not_found"
+	// NotRegistered means the client has to register before the request
+	NotRegistered ErrorCode = "not_registered"
+	// RateLimited means the request came too soon, see RetryAfter
+	RateLimited ErrorCode = "rate_limited"
+	// Malformed means the content of the message could not be understood
+	Malformed ErrorCode = "malformed"
+	// UnsupportedType means the receiver does not handle messages of the type
+	UnsupportedType ErrorCode = "unsupported_type"
+	// Unauthorized means the sender may not send the message, for example
+	// because it was not encrypted
+	Unauthorized ErrorCode = "unauthorized"
+	// HandshakeFailed means a handshake message did not fit the handshake
+	HandshakeFailed ErrorCode = "handshake_failed"
+	// RoomNotFound means the room a request names does not exist
+	RoomNotFound ErrorCode = "room_not_found"
+	// NotMember means the client is not a member of the room
+	NotMember ErrorCode = "not_member"
+	// TooLarge means the message is larger than the receiver accepts
+	TooLarge ErrorCode = "too_large"
+	// MailboxFull means the recipient's mailbox is at its quota, see
+	// RetryAfter
+	MailboxFull ErrorCode = "mailbox_full"
+)
+
+// errors with only a code match every ProtocolError with that code in
+// errors.Is
+var (
+	ErrPeerNotFound    = &ProtocolError{Code: PeerNotFound}
+	ErrNotRegistered   = &ProtocolError{Code: NotRegistered}
+	ErrRateLimited     = &ProtocolError{Code: RateLimited}
+	ErrMalformed       = &ProtocolError{Code: Malformed}
+	ErrUnsupportedType = &ProtocolError{Code: UnsupportedType}
+	ErrUnauthorized    = &ProtocolError{Code: Unauthorized}
+	ErrHandshakeFailed = &ProtocolError{Code: HandshakeFailed}
+	ErrRoomNotFound    = &ProtocolError{Code: RoomNotFound}
+	ErrNotMember       = &ProtocolError{Code: NotMember}
+	ErrTooLarge        = &ProtocolError{Code: TooLarge}
+	ErrMailboxFull     = &ProtocolError{Code: MailboxFull}
+)
+
+// ProtocolError is an error that travels in an error reply
+type ProtocolError struct {
+	Code    ErrorCode
+	Message string
+	// RetryAfter is how long to wait before sending the request again, zero
+	// when there is no point in waiting
+	RetryAfter time.Duration
+	Details    map[string]string
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Message == "" {
+		return string(e.Code)
+	}
+	return e.Message
+}
+
+// Is matches errors with the same code that carry nothing else, such as
+// ErrPeerNotFound
+func (e *ProtocolError) Is(target error) bool {
+	t, ok := target.(*ProtocolError)
+	return ok && t.Code != "" && t.Code == e.Code && t.Message == ""
+}
+
+// Detail adds a detail to the error and returns it
+func (e *ProtocolError) Detail(key, value string) *ProtocolError {
+	if e.Details == nil {
+		e.Details = make(map[string]string)
+	}
+	e.Details[key] = value
+	return e
+}
+
+// NewProtocolError returns an error with the code and a message formatted
+// like fmt.Sprintf
+func NewProtocolError(code ErrorCode, format string, a ...interface{}) *ProtocolError {
+	return &ProtocolError{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// ErrorReply returns the reply to a message of type t that failed with err.
+// Errors that are not ProtocolErrors are sent without a code.
+func ErrorReply(t string, err error) *Message {
+	m := &Message{Type: t, Error: err.Error()}
+	var pe *ProtocolError
+	if errors.As(err, &pe) {
+		m.Code = pe.Code
+		m.RetryAfter = pe.RetryAfter.Milliseconds()
+		m.Details = pe.Details
+	}
+	return m
+}
+
+// MessageError returns the error an error reply carries, nil when m is not
+// an error reply
+func MessageError(m *Message) *ProtocolError {
+	if m.Error == "" {
+		return nil
+	}
+	return &ProtocolError{
+		Code:       m.Code,
+		Message:    m.Error,
+		RetryAfter: time.Duration(m.RetryAfter) * time.Millisecond,
+		Details:    m.Details,
+	}
+}
+
+// ErrorKind says how much of the client an error takes down
+type ErrorKind int
+
+const (
+	// IgnorableError only costs the message that caused it
+	IgnorableError ErrorKind = iota
+	// SessionError ends the session with the peer the message came from
+	SessionError
+	// FatalError leaves the client unable to go on, for example because the
+	// rendezvous server refused it
+	FatalError
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case IgnorableError:
+		return "ignorable"
+	case SessionError:
+		return "session"
+	case FatalError:
+		return "fatal"
+	}
+	return fmt.Sprintf("ErrorKind(%d)", int(k))
+}
+
+// Error is an error the client ran into while handling a message
+type Error struct {
+	Kind ErrorKind
+	// Type is the type of the message that caused the error
+	Type string
+	// Conn is the Conn the message arrived on
+	Conn Conn
+	// Session is the session the message belongs to, nil for the rendezvous
+	// server and for unknown addresses
+	Session *Session
+	Err     error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// FromServer reports whether the message that caused the error came from the
+// rendezvous server
+func (e *Error) FromServer(c Client) bool {
+	return e.Conn != nil && e.Conn == c.GetServerConn()
+}
+
+// NewError returns an error of the kind
+func NewError(kind ErrorKind, err error) *Error {
+	return &Error{Kind: kind, Err: err}
+}
+
+func sessionError(err error) error {
+	return NewError(SessionError, err)
+}
+
+func fatalError(err error) error {
+	return NewError(FatalError, err)
+}
+
+// handleError works out what an error a handler returned costs the client,
+// lets the peer know about the errors its messages cause and reports the
+// error to the client
+func handleError(client Client, c Conn, m *Message, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		e = NewError(IgnorableError, err)
+	} else if error(e) != err {
+		// keep the context the error was wrapped in
+		e = NewError(e.Kind, err)
+	}
+	e.Type = m.Type
+	e.Conn = c
+	if s, ok := client.GetSessions().ByConn(c); ok {
+		e.Session = s
+	}
+
+	s := e.Session
+	switch {
+	case e.Kind == SessionError && s != nil:
+		// the peer may not have the keys yet, it then finds out when its
+		// handshake times out
+		if s.Established() {
+			c.Send(&Message{
+				Type:    "disconnect",
+				PeerID:  client.GetSelf().ID,
+				Content: &Disconnect{Reason: e.Error()},
+				Encrypt: true,
+			})
+		}
+		if client.EndSession(s) {
+			client.DisconnectedCallback(client, s, e.Error())
+		}
+	case e.Kind == IgnorableError && s != nil && s.Established() && m.Error == "":
+		// answer with the error under the message's type, errors are never
+		// answered so that two clients can not bounce them back and forth
+		reply := ErrorReply(m.Type, e.Err)
+		reply.PeerID = client.GetSelf().ID
+		reply.Encrypt = true
+		c.Send(reply)
+	}
+
+	client.ErrorCallback(client, e)
+}
+
+// peerErrorHandler reports an error a peer answered one of the client's
+// messages with
+func peerErrorHandler(c Client, peerConn Conn, m *Message) (*Message, error) {
+	s, ok := c.GetSessions().ByConn(peerConn)
+	if !ok || !m.WasEncrypted() {
+		return nil, nil
+	}
+	c.GetLog().Printf("peer %s rejected a %s message: %s", s.GetPeer().Username, m.Type, m.Error)
+	c.ErrorCallback(c, &Error{
+		Kind:    IgnorableError,
+		Type:    m.Type,
+		Conn:    peerConn,
+		Session: s,
+		Err:     fmt.Errorf("%s rejected a %s message: %w", s.GetPeer().Username, m.Type, MessageError(m)),
+	})
+	return nil, nil
+}
@@ -0,0 +1,163 @@
+package shared
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxDatagramSize is the largest datagram sent on a UDP Conn. It stays
+	// under common path MTUs once IP and UDP headers are added.
+	MaxDatagramSize = 1200
+	// MaxMessageSize is the largest message a Conn will send or reassemble
+	MaxMessageSize = 1 << 20
+	// FragmentTimeout is how long a partially received message is kept
+	FragmentTimeout = 10 * time.Second
+	// MaxBufferedBytes caps the memory held by incomplete messages
+	MaxBufferedBytes = 8 << 20
+)
+
+// the first byte of every datagram says whether it carries a whole message or
+// a fragment of one
+const (
+	datagramWhole    byte = 0
+	datagramFragment byte = 1
+)
+
+// kind + fragment ID + index + count
+const fragmentHeaderSize = 1 + 4 + 2 + 2
+
+const maxFragmentPayload = MaxDatagramSize - fragmentHeaderSize
+
+// Fragment splits a serialized message into datagrams of at most
+// MaxDatagramSize bytes. id must be unique among the sender's messages that
+// could be in flight at the same time.
+func Fragment(b []byte, id uint32) ([][]byte, error) {
+	if len(b) > MaxMessageSize {
+		return nil, errors.New("message is too large to send")
+	}
+
+	if len(b)+1 <= MaxDatagramSize {
+		return [][]byte{append([]byte{datagramWhole}, b...)}, nil
+	}
+
+	count := (len(b) + maxFragmentPayload - 1) / maxFragmentPayload
+	ds := make([][]byte, 0, count)
+	for i := 0; i < count; i += 1 {
+		end := (i + 1) * maxFragmentPayload
+		if end > len(b) {
+			end = len(b)
+		}
+		chunk := b[i*maxFragmentPayload : end]
+
+		d := make([]byte, fragmentHeaderSize, fragmentHeaderSize+len(chunk))
+		d[0] = datagramFragment
+		binary.BigEndian.PutUint32(d[1:5], id)
+		binary.BigEndian.PutUint16(d[5:7], uint16(i))
+		binary.BigEndian.PutUint16(d[7:9], uint16(count))
+		ds = append(ds, append(d, chunk...))
+	}
+	return ds, nil
+}
+
+type partial struct {
+	fragments [][]byte
+	received  int
+	size      int
+	expires   time.Time
+}
+
+// Reassembler collects fragments into whole messages. Incomplete messages are
+// dropped once they time out or when they would exceed the memory cap.
+type Reassembler struct {
+	partials map[string]*partial
+	buffered int
+	m        *sync.Mutex
+}
+
+func (r *Reassembler) expire(now time.Time) {
+	for k, p := range r.partials {
+		if now.After(p.expires) {
+			r.buffered -= p.size
+			delete(r.partials, k)
+		}
+	}
+}
+
+// Add processes a datagram received from the sender identified by from. It
+// returns the whole message once every fragment has arrived and nil while it
+// is still incomplete.
+func (r *Reassembler) Add(from string, d []byte) ([]byte, error) {
+	if len(d) == 0 {
+		return nil, errors.New("empty datagram")
+	}
+	if d[0] == datagramWhole {
+		return d[1:], nil
+	}
+	if d[0] != datagramFragment || len(d) < fragmentHeaderSize {
+		return nil, errors.New("malformed datagram")
+	}
+
+	id := binary.BigEndian.Uint32(d[1:5])
+	index := int(binary.BigEndian.Uint16(d[5:7]))
+	count := int(binary.BigEndian.Uint16(d[7:9]))
+	chunk := d[fragmentHeaderSize:]
+	if count == 0 || index >= count || count*maxFragmentPayload > MaxMessageSize+maxFragmentPayload {
+		return nil, errors.New("malformed fragment header")
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	now := time.Now()
+	r.expire(now)
+
+	key := from + "/" + strconv.FormatUint(uint64(id), 10)
+	p, ok := r.partials[key]
+	if !ok {
+		p = &partial{
+			fragments: make([][]byte, count),
+			expires:   now.Add(FragmentTimeout),
+		}
+		r.partials[key] = p
+	}
+	if len(p.fragments) != count {
+		return nil, errors.New("fragment count changed")
+	}
+	if p.fragments[index] != nil {
+		// duplicate
+		return nil, nil
+	}
+	if r.buffered+len(chunk) > MaxBufferedBytes {
+		r.buffered -= p.size
+		delete(r.partials, key)
+		return nil, errors.New("dropping fragmented message, reassembly buffer is full")
+	}
+
+	p.fragments[index] = append([]byte(nil), chunk...)
+	p.received += 1
+	p.size += len(chunk)
+	r.buffered += len(chunk)
+	if p.received < count {
+		return nil, nil
+	}
+
+	r.buffered -= p.size
+	delete(r.partials, key)
+
+	b := make([]byte, 0, p.size)
+	for _, f := range p.fragments {
+		b = append(b, f...)
+	}
+	return b, nil
+}
+
+func NewReassembler() *Reassembler {
+	return &Reassembler{
+		partials: make(map[string]*partial),
+		m:        &sync.Mutex{},
+	}
+}
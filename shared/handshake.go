@@ -0,0 +1,440 @@
+package shared
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// NoiseProtocol is the name of the Noise framework protocol implemented by
+// Handshake. It is exactly 32 bytes so it is used as the initial hash as is.
+const NoiseProtocol = "Noise_XX_25519_ChaChaPoly_SHA256"
+
+var prologue = []byte("udp-hole-punching")
+
+// HandshakeMessage carries one message of the handshake pattern
+type HandshakeMessage struct {
+	Step    int    `json:"step"`
+	Payload string `json:"payload"`
+}
+
+func hkdf(ck [32]byte, ikm []byte) ([32]byte, [32]byte) {
+	var out1, out2 [32]byte
+	mac := hmac.New(sha256.New, ck[:])
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write([]byte{0x01})
+	copy(out1[:], mac.Sum(nil))
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write(append(out1[:], 0x02))
+	copy(out2[:], mac.Sum(nil))
+	return out1, out2
+}
+
+func dh(pri, pub [32]byte) ([32]byte, error) {
+	var secret [32]byte
+	bs, err := curve25519.X25519(pri[:], pub[:])
+	if err != nil {
+		return secret, err
+	}
+	copy(secret[:], bs)
+	return secret, nil
+}
+
+func genEphemeral() (*KeyPair, error) {
+	kp := &KeyPair{}
+	_, err := rand.Read(kp.Private[:])
+	if err != nil {
+		return nil, err
+	}
+	pub, err := curve25519.X25519(kp.Private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(kp.Public[:], pub)
+	return kp, nil
+}
+
+// symmetricState is the SymmetricState object of the Noise specification
+type symmetricState struct {
+	ck     [32]byte
+	h      [32]byte
+	k      [32]byte
+	hasKey bool
+	n      uint64
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	s.h = sha256.Sum256(append(s.h[:], data...))
+}
+
+func (s *symmetricState) mixKey(ikm [32]byte) {
+	s.ck, s.k = hkdf(s.ck, ikm[:])
+	s.hasKey = true
+	s.n = 0
+}
+
+func (s *symmetricState) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], s.n)
+	return nonce
+}
+
+func (s *symmetricState) encryptAndHash(pt []byte) ([]byte, error) {
+	if !s.hasKey {
+		s.mixHash(pt)
+		return pt, nil
+	}
+
+	aead, err := chacha20poly1305.New(s.k[:])
+	if err != nil {
+		return nil, err
+	}
+	ct := aead.Seal(nil, s.nonce(), pt, s.h[:])
+	s.n += 1
+	s.mixHash(ct)
+	return ct, nil
+}
+
+func (s *symmetricState) decryptAndHash(ct []byte) ([]byte, error) {
+	if !s.hasKey {
+		s.mixHash(ct)
+		return ct, nil
+	}
+
+	aead, err := chacha20poly1305.New(s.k[:])
+	if err != nil {
+		return nil, err
+	}
+	pt, err := aead.Open(nil, s.nonce(), ct, s.h[:])
+	if err != nil {
+		return nil, err
+	}
+	s.n += 1
+	s.mixHash(ct)
+	return pt, nil
+}
+
+func (s *symmetricState) split() ([32]byte, [32]byte) {
+	return hkdf(s.ck, nil)
+}
+
+// Handshake is a Noise XX handshake between two static key pairs:
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+//
+// It remembers the last message it wrote so that lost messages can be sent
+// again: the initiator repeats its latest message until the responder is
+// heard from over the transport keys and a responder answers a repeated
+// message with the reply it already computed.
+type Handshake struct {
+	initiator bool
+	s         *KeyPair
+	e         *KeyPair
+	rs        [32]byte
+	re        [32]byte
+	ss        *symmetricState
+	step      int
+	last      *HandshakeMessage
+	confirmed bool
+	m         *sync.Mutex
+}
+
+// the number of messages in the XX pattern
+const handshakeSteps = 3
+
+func (h *Handshake) write() (*HandshakeMessage, error) {
+	var out []byte
+	var err error
+	switch h.step {
+	case 0:
+		// -> e
+		h.e, err = genEphemeral()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, h.e.Public[:]...)
+		h.ss.mixHash(h.e.Public[:])
+	case 1:
+		// <- e, ee, s, es
+		h.e, err = genEphemeral()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, h.e.Public[:]...)
+		h.ss.mixHash(h.e.Public[:])
+		ee, err := dh(h.e.Private, h.re)
+		if err != nil {
+			return nil, err
+		}
+		h.ss.mixKey(ee)
+		ct, err := h.ss.encryptAndHash(h.s.Public[:])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ct...)
+		es, err := dh(h.s.Private, h.re)
+		if err != nil {
+			return nil, err
+		}
+		h.ss.mixKey(es)
+	case 2:
+		// -> s, se
+		ct, err := h.ss.encryptAndHash(h.s.Public[:])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ct...)
+		se, err := dh(h.s.Private, h.re)
+		if err != nil {
+			return nil, err
+		}
+		h.ss.mixKey(se)
+	default:
+		return nil, errors.New("handshake is already complete")
+	}
+
+	// the payload is empty but still authenticated
+	ct, err := h.ss.encryptAndHash(nil)
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, ct...)
+
+	h.last = &HandshakeMessage{
+		Step:    h.step,
+		Payload: base64.StdEncoding.EncodeToString(out),
+	}
+	h.step += 1
+	return h.last, nil
+}
+
+func (h *Handshake) read(msg []byte) error {
+	var err error
+	switch h.step {
+	case 0:
+		// -> e
+		if len(msg) < 32 {
+			return errors.New("handshake message is too short")
+		}
+		copy(h.re[:], msg[:32])
+		h.ss.mixHash(h.re[:])
+		msg = msg[32:]
+	case 1:
+		// <- e, ee, s, es
+		if len(msg) < 32+48 {
+			return errors.New("handshake message is too short")
+		}
+		copy(h.re[:], msg[:32])
+		h.ss.mixHash(h.re[:])
+		ee, err := dh(h.e.Private, h.re)
+		if err != nil {
+			return err
+		}
+		h.ss.mixKey(ee)
+		rs, err := h.ss.decryptAndHash(msg[32 : 32+48])
+		if err != nil {
+			return err
+		}
+		copy(h.rs[:], rs)
+		es, err := dh(h.e.Private, h.rs)
+		if err != nil {
+			return err
+		}
+		h.ss.mixKey(es)
+		msg = msg[32+48:]
+	case 2:
+		// -> s, se
+		if len(msg) < 48 {
+			return errors.New("handshake message is too short")
+		}
+		rs, err := h.ss.decryptAndHash(msg[:48])
+		if err != nil {
+			return err
+		}
+		copy(h.rs[:], rs)
+		se, err := dh(h.e.Private, h.rs)
+		if err != nil {
+			return err
+		}
+		h.ss.mixKey(se)
+		msg = msg[48:]
+	default:
+		return errors.New("handshake is already complete")
+	}
+
+	_, err = h.ss.decryptAndHash(msg)
+	if err != nil {
+		return err
+	}
+
+	h.step += 1
+	return nil
+}
+
+// Next returns the message the local side should send, writing the first
+// message of an initiator if needed. It returns nil when there is nothing to
+// send until the peer replies.
+func (h *Handshake) Next() (*HandshakeMessage, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if h.initiator && h.step == 0 {
+		return h.write()
+	}
+	if h.confirmed {
+		return nil, nil
+	}
+	return h.last, nil
+}
+
+// Handle reads a handshake message from the peer and returns the reply that
+// should be sent back, if any
+func (h *Handshake) Handle(hm *HandshakeMessage) (*HandshakeMessage, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	// a repeat of a message that was already processed means that our reply
+	// was lost
+	if hm.Step < h.step {
+		if h.last != nil && h.last.Step == hm.Step+1 {
+			return h.last, nil
+		}
+		return nil, nil
+	}
+	if hm.Step > h.step {
+		return nil, fmt.Errorf("expected handshake message %d but received %d", h.step, hm.Step)
+	}
+
+	msg, err := base64.StdEncoding.DecodeString(hm.Payload)
+	if err != nil {
+		return nil, err
+	}
+	err = h.read(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.step == handshakeSteps {
+		// the responder has heard the last message
+		h.confirmed = true
+		h.e = nil
+		return nil, nil
+	}
+
+	reply, err := h.write()
+	if h.step == handshakeSteps {
+		// the ephemeral key is not needed anymore
+		h.e = nil
+	}
+	return reply, err
+}
+
+// IsRestart reports whether hm is the first message of a new handshake rather
+// than a repeat of the one this responder is processing
+func (h *Handshake) IsRestart(hm *HandshakeMessage) bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if h.initiator || hm.Step != 0 || h.step == 0 {
+		return false
+	}
+	msg, err := base64.StdEncoding.DecodeString(hm.Payload)
+	if err != nil || len(msg) < 32 {
+		return false
+	}
+	return !hmac.Equal(msg[:32], h.re[:])
+}
+
+// Confirm records that the peer has been heard from over the transport keys
+// so the last handshake message no longer needs to be repeated
+func (h *Handshake) Confirm() {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.step == handshakeSteps {
+		h.confirmed = true
+	}
+}
+
+func (h *Handshake) Complete() bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.step == handshakeSteps
+}
+
+func (h *Handshake) Initiator() bool {
+	return h.initiator
+}
+
+// RemoteStatic returns the static public key the peer authenticated with
+func (h *Handshake) RemoteStatic() [32]byte {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.rs
+}
+
+// Hash returns the handshake hash which binds the whole transcript
+func (h *Handshake) Hash() [32]byte {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.ss.h
+}
+
+// Root returns the root key the transport Ratchet is seeded with
+func (h *Handshake) Root() [32]byte {
+	h.m.Lock()
+	defer h.m.Unlock()
+	k1, k2 := h.ss.split()
+	return deriveKey(append(k1[:], k2[:]...), "transport root key")
+}
+
+func NewHandshake(initiator bool, s *KeyPair) *Handshake {
+	ss := &symmetricState{}
+	copy(ss.h[:], NoiseProtocol)
+	ss.ck = ss.h
+	ss.mixHash(prologue)
+
+	return &Handshake{
+		initiator: initiator,
+		s:         s,
+		ss:        ss,
+		m:         &sync.Mutex{},
+	}
+}
+
+// HandleHandshake passes a handshake message to the Conn's handshake,
+// starting a new responder handshake when the message opens one. It returns
+// the reply to send and whether this message completed the handshake.
+func HandleHandshake(c Conn, s *KeyPair, hm *HandshakeMessage) (*HandshakeMessage, bool, error) {
+	h := c.GetHandshake()
+	if hm.Step == 0 && (h == nil || h.IsRestart(hm)) {
+		h = NewHandshake(false, s)
+		c.SetHandshake(h)
+	}
+	if h == nil {
+		return nil, false, errors.New("received handshake message without a handshake in progress")
+	}
+	if h.Initiator() && hm.Step == 0 {
+		return nil, false, errors.New("both sides of the handshake are initiators")
+	}
+
+	complete := h.Complete()
+	reply, err := h.Handle(hm)
+	if err != nil {
+		return nil, false, err
+	}
+	return reply, !complete && h.Complete(), nil
+}
@@ -0,0 +1,182 @@
+package shared
+
+import (
+	"testing"
+)
+
+// handshakeConn is a Conn that only holds a handshake
+type handshakeConn struct {
+	Conn
+	h *Handshake
+}
+
+func (c *handshakeConn) GetHandshake() *Handshake {
+	return c.h
+}
+
+func (c *handshakeConn) SetHandshake(h *Handshake) {
+	c.h = h
+}
+
+func genKeyPair(t *testing.T) *KeyPair {
+	kp, err := GenKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kp
+}
+
+// respond passes a message of the initiator to the responder side of c
+func respond(t *testing.T, c *handshakeConn, s *KeyPair, hm *HandshakeMessage) (*HandshakeMessage, bool) {
+	reply, complete, err := HandleHandshake(c, s, hm)
+	if err != nil {
+		t.Fatalf("responder could not handle message %d: %s", hm.Step, err)
+	}
+	return reply, complete
+}
+
+func checkKeys(t *testing.T, i *Handshake, r *Handshake, is, rs *KeyPair) {
+	if !i.Complete() || !r.Complete() {
+		t.Fatalf("handshake is not complete: initiator %t responder %t", i.Complete(), r.Complete())
+	}
+	if i.Hash() != r.Hash() {
+		t.Error("handshake hashes differ")
+	}
+	if i.Root() != r.Root() {
+		t.Error("root keys differ")
+	}
+	if i.RemoteStatic() != rs.Public {
+		t.Error("initiator did not learn the responder's static key")
+	}
+	if r.RemoteStatic() != is.Public {
+		t.Error("responder did not learn the initiator's static key")
+	}
+}
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	is, rs := genKeyPair(t), genKeyPair(t)
+	i := NewHandshake(true, is)
+	c := &handshakeConn{}
+
+	m1, err := i.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, complete := respond(t, c, rs, m1)
+	if m2 == nil || complete {
+		t.Fatalf("responder replied %v to the first message, complete %t", m2, complete)
+	}
+	m3, err := i.Handle(m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m3 == nil || !i.Complete() {
+		t.Fatal("initiator did not finish after the second message")
+	}
+	reply, complete := respond(t, c, rs, m3)
+	if reply != nil || !complete {
+		t.Fatalf("responder replied %v to the last message, complete %t", reply, complete)
+	}
+
+	checkKeys(t, i, c.h, is, rs)
+}
+
+func TestHandshakeRetransmit(t *testing.T) {
+	is, rs := genKeyPair(t), genKeyPair(t)
+	i := NewHandshake(true, is)
+	c := &handshakeConn{}
+
+	m1, err := i.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, _ := respond(t, c, rs, m1)
+
+	// the reply was lost so the initiator repeats its first message and the
+	// responder answers with the reply it already computed
+	again, err := i.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != m1 {
+		t.Fatal("initiator did not repeat its first message")
+	}
+	repeated, _ := respond(t, c, rs, again)
+	if repeated != m2 {
+		t.Fatal("responder did not repeat its reply")
+	}
+
+	m3, err := i.Handle(repeated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, complete := respond(t, c, rs, m3)
+	if !complete {
+		t.Fatal("responder did not complete on the last message")
+	}
+
+	// until the responder is heard from the last message is repeated, and
+	// the responder ignores it
+	last, err := i.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != m3 {
+		t.Fatal("initiator did not repeat its last message")
+	}
+	reply, complete := respond(t, c, rs, last)
+	if reply != nil || complete {
+		t.Fatalf("responder replied %v to a repeated last message, complete %t", reply, complete)
+	}
+	i.Confirm()
+	last, err = i.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != nil {
+		t.Fatal("initiator repeated its last message after it was confirmed")
+	}
+
+	checkKeys(t, i, c.h, is, rs)
+}
+
+func TestHandshakeRestart(t *testing.T) {
+	is, rs := genKeyPair(t), genKeyPair(t)
+	c := &handshakeConn{}
+
+	// the initiator gives up after the first message and starts over with a
+	// new ephemeral key
+	first, err := NewHandshake(true, is).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	respond(t, c, rs, first)
+	stale := c.h
+
+	i := NewHandshake(true, is)
+	m1, err := i.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stale.IsRestart(m1) {
+		t.Fatal("the first message of a new handshake is not seen as a restart")
+	}
+	if stale.IsRestart(first) {
+		t.Fatal("a repeated first message is seen as a restart")
+	}
+
+	m2, _ := respond(t, c, rs, m1)
+	if c.h == stale {
+		t.Fatal("responder kept the stale handshake")
+	}
+	m3, err := i.Handle(m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, complete := respond(t, c, rs, m3)
+	if !complete {
+		t.Fatal("restarted handshake did not complete")
+	}
+
+	checkKeys(t, i, c.h, is, rs)
+}
@@ -0,0 +1,287 @@
+package shared
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// scrypt parameters used to derive the key file encryption key
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// bounds of the scrypt parameters accepted from a key file, a file could
+// otherwise make Load use an unbounded amount of memory and time
+const (
+	maxScryptN = 1 << 20
+	maxScryptR = 32
+	maxScryptP = 16
+)
+
+// identityFile is the on disk format of an IdentityStore. The public key and
+// ID are stored in the clear so an identity can be shown without its
+// passphrase.
+type identityFile struct {
+	Version    int    `json:"version"`
+	ID         string `json:"id"`
+	PublicKey  string `json:"publicKey"`
+	KDF        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       string `json:"salt"`
+	Nonce      string `json:"nonce"`
+	PrivateKey string `json:"privateKey"`
+}
+
+// IdentityStore is a key file holding a client's static key pair encrypted
+// with a key derived from a passphrase
+type IdentityStore struct {
+	Path       string
+	passphrase []byte
+}
+
+func (s *IdentityStore) Exists() bool {
+	_, err := os.Stat(s.Path)
+	return err == nil
+}
+
+func readIdentityFile(path string) (*identityFile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &identityFile{}
+	err = json.Unmarshal(b, f)
+	if err != nil {
+		return nil, err
+	}
+	if f.Version != 1 || f.KDF != "scrypt" {
+		return nil, errors.New("unsupported identity file format")
+	}
+	return f, nil
+}
+
+// ReadIdentityID returns the ID stored in a key file without decrypting it
+func ReadIdentityID(path string) (string, error) {
+	f, err := readIdentityFile(path)
+	if err != nil {
+		return "", err
+	}
+	return f.ID, nil
+}
+
+// ReadIdentityPublicKey returns the public key stored in a key file without
+// decrypting it
+func ReadIdentityPublicKey(path string) (string, error) {
+	f, err := readIdentityFile(path)
+	if err != nil {
+		return "", err
+	}
+	return f.PublicKey, nil
+}
+
+func (s *IdentityStore) Load() (*KeyPair, error) {
+	f, err := readIdentityFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(f.Salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(f.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := base64.StdEncoding.DecodeString(f.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := base64.StdEncoding.DecodeString(f.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(pub) != 32 {
+		return nil, errors.New("identity file has an invalid public key")
+	}
+	if f.N < 2 || f.N > maxScryptN || f.R < 1 || f.R > maxScryptR || f.P < 1 || f.P > maxScryptP {
+		return nil, errors.New("identity file has unsupported scrypt parameters")
+	}
+
+	key, err := scrypt.Key(s.passphrase, salt, f.N, f.R, f.P, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// the public key is authenticated along with the private key
+	pri, err := aead.Open(nil, nonce, ct, pub)
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupt identity file")
+	}
+	if len(pri) != 32 {
+		return nil, errors.New("identity file has an invalid private key")
+	}
+
+	kp := &KeyPair{}
+	copy(kp.Private[:], pri)
+	copy(kp.Public[:], pub)
+	return kp, nil
+}
+
+func (s *IdentityStore) Save(kp *KeyPair) error {
+	return s.saveTo(s.Path, kp)
+}
+
+func (s *IdentityStore) saveTo(path string, kp *KeyPair) error {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+
+	key, err := scrypt.Key(s.passphrase, salt, scryptN, scryptR, scryptP, chacha20poly1305.KeySize)
+	if err != nil {
+		return err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(identityFile{
+		Version:    1,
+		ID:         GenID(kp.Public),
+		PublicKey:  base64.StdEncoding.EncodeToString(kp.Public[:]),
+		KDF:        "scrypt",
+		N:          scryptN,
+		R:          scryptR,
+		P:          scryptP,
+		Salt:       base64.StdEncoding.EncodeToString(salt),
+		Nonce:      base64.StdEncoding.EncodeToString(nonce),
+		PrivateKey: base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, kp.Private[:], kp.Public[:])),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// Create generates a new key pair and saves it, refusing to overwrite an
+// existing identity
+func (s *IdentityStore) Create() (*KeyPair, error) {
+	if s.Exists() {
+		return nil, errors.New("identity file already exists")
+	}
+
+	kp, err := GenKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	return kp, s.Save(kp)
+}
+
+// Rotate replaces the stored key pair with a new one. The previous key file
+// is kept next to the new one with a .old suffix.
+func (s *IdentityStore) Rotate() (*KeyPair, error) {
+	// make sure the passphrase opens the current identity
+	_, err := s.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	kp, err := GenKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	return kp, s.Replace(kp)
+}
+
+// Replace saves the key pair in place of the stored one. A previous key file
+// is kept next to the new one with a .old suffix.
+func (s *IdentityStore) Replace(kp *KeyPair) error {
+	// the new key is saved before anything is moved so that a failure leaves
+	// the current identity and any earlier .old file as they were
+	tmp := s.Path + ".new"
+	err := s.saveTo(tmp, kp)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if s.Exists() {
+		err = os.Rename(s.Path, s.Path+".old")
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	err = os.Rename(tmp, s.Path)
+	if err != nil {
+		return fmt.Errorf("the new key is in %s: %w", tmp, err)
+	}
+	return nil
+}
+
+func NewIdentityStore(path string, passphrase []byte) *IdentityStore {
+	return &IdentityStore{
+		Path:       path,
+		passphrase: passphrase,
+	}
+}
+
+// ReadPassphrase prompts for a passphrase on the terminal without echoing it
+func ReadPassphrase(prompt string) ([]byte, error) {
+	fmt.Print(prompt)
+	b, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Print("\n")
+	return b, err
+}
+
+// OpenIdentityStore prompts for the passphrase of the key file at path. A key
+// file that does not exist yet is created with a new key pair.
+func OpenIdentityStore(path string, prompt string) (*IdentityStore, error) {
+	pass, err := ReadPassphrase(prompt)
+	if err != nil {
+		return nil, err
+	}
+	s := NewIdentityStore(path, pass)
+
+	if s.Exists() {
+		// make sure the passphrase is right before going any further
+		_, err = s.Load()
+		return s, err
+	}
+
+	again, err := ReadPassphrase(prompt + "(again) ")
+	if err != nil {
+		return nil, err
+	}
+	if string(again) != string(pass) {
+		return nil, errors.New("passphrases do not match")
+	}
+	_, err = s.Create()
+	return s, err
+}
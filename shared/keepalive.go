@@ -0,0 +1,65 @@
+package shared
+
+import (
+	"sync"
+	"time"
+)
+
+// KeepalivePolicy decides how often the peer is pinged and how many pings in
+// a row may go unanswered before the peer is considered gone. A zero
+// Interval disables keepalives.
+type KeepalivePolicy struct {
+	Interval  time.Duration
+	MaxMissed int
+}
+
+// DefaultKeepalivePolicy pings well within the UDP mapping timeout of most
+// NATs
+var DefaultKeepalivePolicy = KeepalivePolicy{
+	Interval:  15 * time.Second,
+	MaxMissed: 4,
+}
+
+// Disconnect is sent to the peer when a session is ended on purpose
+type Disconnect struct {
+	Reason string `json:"reason"`
+}
+
+// Liveness counts the pings sent on a Conn since the last authenticated
+// message arrived on it
+type Liveness struct {
+	missed   int
+	lastSeen time.Time
+	m        *sync.Mutex
+}
+
+// Seen records that an authenticated message arrived
+func (l *Liveness) Seen() {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.missed = 0
+	l.lastSeen = time.Now()
+}
+
+// Ping records that a ping was sent and returns how many pings in a row
+// have gone unanswered before it
+func (l *Liveness) Ping() int {
+	l.m.Lock()
+	defer l.m.Unlock()
+	missed := l.missed
+	l.missed += 1
+	return missed
+}
+
+func (l *Liveness) LastSeen() time.Time {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.lastSeen
+}
+
+func NewLiveness() *Liveness {
+	return &Liveness{
+		lastSeen: time.Now(),
+		m:        &sync.Mutex{},
+	}
+}
@@ -0,0 +1,184 @@
+package shared
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/wilfreddenton/crypto"
+)
+
+const (
+	// DefaultMailTTL is how long the rendezvous server keeps mail for a peer
+	DefaultMailTTL = 7 * 24 * time.Hour
+	// DefaultMailCount is how many messages the server keeps for a peer
+	DefaultMailCount = 100
+	// DefaultMailBytes is how many sealed bytes the server keeps for a peer
+	DefaultMailBytes = 256 * 1024
+	// MaxMailSize is the largest sealed message the server accepts
+	MaxMailSize = 8 * 1024
+)
+
+// Mail is a message left on the rendezvous server for a peer that is not
+// online. It is sealed to the recipient's public key with a key only the
+// sender's static key and a fresh ephemeral key agree on, so the server can
+// neither read it nor forge its sender.
+type Mail struct {
+	ID        string `json:"id,omitempty"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Sender    string `json:"sender"`
+	Ephemeral string `json:"ephemeral"`
+	Sealed    string `json:"sealed"`
+	// unix time after which the server deletes the mail
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// mailContent is what a Mail seals
+type mailContent struct {
+	Username string `json:"username"`
+	Chat     Chat   `json:"chat"`
+	SentAt   int64  `json:"sentAt"`
+}
+
+func mailKey(ephemeral, static [32]byte, ephemeralPub, senderPub, recipientPub [32]byte) [32]byte {
+	secret := make([]byte, 0, 5*32)
+	secret = append(secret, ephemeral[:]...)
+	secret = append(secret, static[:]...)
+	secret = append(secret, ephemeralPub[:]...)
+	secret = append(secret, senderPub[:]...)
+	secret = append(secret, recipientPub[:]...)
+	return deriveKey(secret, "mail key")
+}
+
+// SealMail seals a line of text from self to the peer, whose public key must
+// be known
+func SealMail(self *Peer, to *Peer, text string) (*Mail, *Chat, error) {
+	recipient, err := to.GetPublicKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	if GenID(recipient) != to.ID {
+		return nil, nil, fmt.Errorf("public key does not belong to peer %s", to.ID)
+	}
+
+	kp, err := self.GetKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	eph, err := GenKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key := mailKey(
+		crypto.GenSharedSecret(eph.Private, recipient),
+		crypto.GenSharedSecret(kp.Private, recipient),
+		eph.Public, kp.Public, recipient,
+	)
+
+	content := &mailContent{
+		Username: self.Username,
+		Chat:     Chat{ID: GenMessageID(), Text: text},
+		SentAt:   time.Now().Unix(),
+	}
+	b, err := json.Marshal(content)
+	if err != nil {
+		return nil, nil, err
+	}
+	ct, err := crypto.Encrypt(b, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &Mail{
+		From:      self.ID,
+		To:        to.ID,
+		Sender:    self.PublicKey,
+		Ephemeral: base64.StdEncoding.EncodeToString(eph.Public[:]),
+		Sealed:    base64.StdEncoding.EncodeToString(ct),
+	}, &content.Chat, nil
+}
+
+// OpenMail opens mail sealed to self. It returns the sender and what they
+// wrote.
+func OpenMail(self *Peer, mail *Mail) (*Peer, *Chat, time.Time, error) {
+	sender, err := decodeKey(mail.Sender)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	if GenID(sender) != mail.From {
+		return nil, nil, time.Time{}, fmt.Errorf("mail %s carries a key that does not belong to its sender", mail.ID)
+	}
+	ephemeral, err := decodeKey(mail.Ephemeral)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	ct, err := base64.StdEncoding.DecodeString(mail.Sealed)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+
+	kp, err := self.GetKeyPair()
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	key := mailKey(
+		crypto.GenSharedSecret(kp.Private, ephemeral),
+		crypto.GenSharedSecret(kp.Private, sender),
+		ephemeral, sender, kp.Public,
+	)
+
+	b, err := crypto.Decrypt(ct, key)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	var content mailContent
+	err = json.Unmarshal(b, &content)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+
+	peer := &Peer{ID: mail.From, Username: content.Username}
+	peer.SetPublicKey(sender)
+	return peer, &content.Chat, time.Unix(content.SentAt, 0), nil
+}
+
+// Inbox remembers the mail a client has been handed so that mail the server
+// delivers again, because the acknowledgement was lost, is not shown twice
+type Inbox struct {
+	seen map[string]time.Time
+	m    *sync.Mutex
+}
+
+// Seen records the mail and reports whether it had been seen before
+func (in *Inbox) Seen(mail *Mail) bool {
+	in.m.Lock()
+	defer in.m.Unlock()
+
+	now := time.Now()
+	for id, expires := range in.seen {
+		if now.After(expires) {
+			delete(in.seen, id)
+		}
+	}
+
+	if _, ok := in.seen[mail.ID]; ok {
+		return true
+	}
+	expires := time.Unix(mail.Expires, 0)
+	if mail.Expires == 0 {
+		expires = now.Add(DefaultMailTTL)
+	}
+	in.seen[mail.ID] = expires
+	return false
+}
+
+func NewInbox() *Inbox {
+	return &Inbox{
+		seen: make(map[string]time.Time),
+		m:    &sync.Mutex{},
+	}
+}
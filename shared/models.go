@@ -2,15 +2,20 @@ package shared
 
 import (
 	"bufio"
+	"context"
 	"crypto/cipher"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Conn interface {
@@ -19,51 +24,117 @@ type Conn interface {
 	GetAddr() net.Addr
 	GetSecret() ([32]byte, error)
 	SetSecret([32]byte)
+	GetCipher() (Cipher, error)
+	SetCipher(Cipher)
+	GetHandshake() *Handshake
+	SetHandshake(*Handshake)
+	GetReliable() *Reliable
+	GetMux() *Mux
+	GetLiveness() *Liveness
 }
 
 type Client interface {
-	WasKeySent() bool
-	SetKeySent(bool)
-	WasKeyReceived() bool
-	SetKeyReceived(bool)
 	GetServer() Server
 	GetLog() *log.Logger
 	GetSelf() *Peer
-	GetPeer() *Peer
-	SetPeer(*Peer)
-	GetPeerConn() Conn
-	SetPeerConn(Conn)
 	GetServerConn() Conn
 	SetServerConn(Conn)
-	Connect()
+	GetSessions() *Sessions
+	GetEndpoint() Endpoint
+	SetEndpoint(Endpoint)
+	GetRekeyPolicy() RekeyPolicy
+	SetRekeyPolicy(RekeyPolicy)
+	GetKeepalivePolicy() KeepalivePolicy
+	SetKeepalivePolicy(KeepalivePolicy)
+	GetPunchStrategy() PunchStrategy
+	SetPunchStrategy(PunchStrategy)
+	Context() context.Context
+	GetVerifiedPeers() *VerifiedPeers
+	Establish(string) error
+	Dialed(string) bool
+	Disconnect(string, string) error
+	EndSession(*Session) bool
+	SendMessage(string, string) (*Chat, error)
+	MarkRead(string, string) error
+	SendSignal(string, string, bool) error
+	GetTransfers() *Transfers
+	SendFile(string, string) (*Transfer, error)
+	AcceptFile(string, string) error
+	ResumeTransfers(string)
+	OpenStream(string, string) (*Stream, error)
+	AcceptStream(string) (*Stream, error)
+	Dial(string, string) (net.Conn, error)
+	Listen(string) (net.Listener, error)
+	ListenPacket(string) (net.PacketConn, error)
+	GetInbox() *Inbox
+	SendMail(string, string) (*Chat, error)
+	GetRooms() *Rooms
+	CreateRoom() error
+	JoinRoom(string) error
+	LeaveRoom(string) error
+	RefreshRoom(string) error
+	SendRoomMessage(string, string) (*Chat, error)
+	ShareRoomKeys(string)
+	Connect(context.Context, *Session)
 	Stop()
-	Start() error
+	Start(context.Context) error
 	RegisteredCallback(Client)
-	ConnectingCallback(Client)
-	ConnectedCallback(Client)
-	MessageCallback(Client, string)
+	ConnectingCallback(Client, *Session)
+	ConnectedCallback(Client, *Session)
+	DisconnectedCallback(Client, *Session, string)
+	MessageCallback(Client, *Session, *Chat)
+	ReceiptCallback(Client, *Session, *Receipt)
+	PeerSignalCallback(Client, *Session, *Signal)
+	FileOfferCallback(Client, *Session, *Transfer)
+	FileProgressCallback(Client, *Session, *Transfer)
+	RoomCallback(Client, *Room)
+	RoomMessageCallback(Client, *Room, *Peer, *Chat)
+	MailCallback(Client, *Peer, *Chat, time.Time)
+	ErrorCallback(Client, *Error)
+	PunchCallback(Client, *Session, *PunchResult)
 	OnRegistered(func(Client))
-	OnConnecting(func(Client))
-	OnConnected(func(Client))
-	OnMessage(func(Client, string))
+	OnConnecting(func(Client, *Session))
+	OnConnected(func(Client, *Session))
+	OnDisconnected(func(Client, *Session, string))
+	OnMessage(func(Client, *Session, *Chat))
+	OnReceipt(func(Client, *Session, *Receipt))
+	OnPeerSignal(func(Client, *Session, *Signal))
+	OnFileOffer(func(Client, *Session, *Transfer))
+	OnFileProgress(func(Client, *Session, *Transfer))
+	OnRoom(func(Client, *Room))
+	OnRoomMessage(func(Client, *Room, *Peer, *Chat))
+	OnMail(func(Client, *Peer, *Chat, time.Time))
+	OnError(func(Client, *Error))
+	OnPunch(func(Client, *Session, *PunchResult))
 }
 
 type Server interface {
 	Stop()
 	Listen()
 	CreateConn(net.Addr) (Conn, error)
-	OnMessage(f func(Conns, Conn, *Message))
+	// Conn returns the Conn at the address
+	Conn(addr string) (Conn, bool)
+	OnMessage(f func(Conn, *Message))
 }
 
 type UDPPayload struct {
 	Bytes []byte
 	Addr  *net.UDPAddr
+	// TTL is the IP TTL to send the payload with, zero for the socket's
+	TTL int
 }
 
 type UDPConn struct {
-	send   chan *UDPPayload
-	addr   *net.UDPAddr
-	secret string
+	send       chan *UDPPayload
+	addr       *net.UDPAddr
+	fragmentID uint32
+	secret     string
+	cipher     Cipher
+	handshake  *Handshake
+	reliable   *Reliable
+	mux        *Mux
+	liveness   *Liveness
+	m          *sync.RWMutex
 }
 
 func convertSecret(secretText string) ([32]byte, error) {
@@ -85,13 +156,33 @@ func convertSecret(secretText string) ([32]byte, error) {
 }
 
 func (c *UDPConn) Send(m *Message) error {
+	if m.Reliable {
+		return c.reliable.Send(m)
+	}
+	return c.write(m)
+}
+
+func (c *UDPConn) write(m *Message) error {
+	return c.WriteTo(m, c.udpAddr())
+}
+
+// WriteTo sends m to addr instead of the Conn's address, it is used to
+// validate an address before the Conn moves to it
+func (c *UDPConn) WriteTo(m *Message, addr *net.UDPAddr) error {
 	b, err := MessageOut(c, m)
 	if err != nil {
 		return err
 	}
 
-	c.send <- &UDPPayload{Bytes: b, Addr: c.addr}
-	return err
+	// split messages that do not fit in a single datagram
+	ds, err := Fragment(b, atomic.AddUint32(&c.fragmentID, 1))
+	if err != nil {
+		return err
+	}
+	for _, d := range ds {
+		c.send <- &UDPPayload{Bytes: d, Addr: addr, TTL: m.TTL}
+	}
+	return nil
 }
 
 func (c *UDPConn) Protocol() string {
@@ -99,30 +190,101 @@ func (c *UDPConn) Protocol() string {
 }
 
 func (c *UDPConn) GetAddr() net.Addr {
+	return c.udpAddr()
+}
+
+func (c *UDPConn) udpAddr() *net.UDPAddr {
+	c.m.RLock()
+	defer c.m.RUnlock()
 	return c.addr
 }
 
+// SetAddr moves the Conn to the address its peer now sends from
+func (c *UDPConn) SetAddr(addr *net.UDPAddr) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.addr = addr
+}
+
 func (c *UDPConn) GetSecret() ([32]byte, error) {
 	return convertSecret(c.secret)
 }
 
 func (c *UDPConn) SetSecret(secret [32]byte) {
 	c.secret = base64.StdEncoding.EncodeToString(secret[:])
+	c.SetCipher(NewStaticCipher(secret))
+}
+
+func (c *UDPConn) GetCipher() (Cipher, error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if c.cipher == nil {
+		return nil, errors.New("cipher has not been set")
+	}
+	return c.cipher, nil
+}
+
+func (c *UDPConn) SetCipher(cipher Cipher) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.cipher = cipher
+}
+
+func (c *UDPConn) GetHandshake() *Handshake {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.handshake
+}
+
+func (c *UDPConn) SetHandshake(h *Handshake) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.handshake = h
+}
+
+func (c *UDPConn) GetReliable() *Reliable {
+	return c.reliable
+}
+
+func (c *UDPConn) GetMux() *Mux {
+	return c.mux
+}
+
+func (c *UDPConn) GetLiveness() *Liveness {
+	return c.liveness
 }
 
 func NewUDPConn(send chan *UDPPayload, addr *net.UDPAddr) *UDPConn {
-	return &UDPConn{
+	c := &UDPConn{
 		send: send,
 		addr: addr,
+		m:    &sync.RWMutex{},
 	}
+	c.reliable = NewReliable(c.write)
+	c.mux = NewMux(c)
+	c.liveness = NewLiveness()
+	return c
 }
 
 type TCPConn struct {
-	C      *net.TCPConn
-	secret string
+	C         *net.TCPConn
+	secret    string
+	cipher    Cipher
+	handshake *Handshake
+	reliable  *Reliable
+	mux       *Mux
+	liveness  *Liveness
+	m         *sync.RWMutex
 }
 
 func (c *TCPConn) Send(m *Message) error {
+	if m.Reliable {
+		return c.reliable.Send(m)
+	}
+	return c.write(m)
+}
+
+func (c *TCPConn) write(m *Message) error {
 	b, err := MessageOut(c, m)
 	if err != nil {
 		return err
@@ -146,10 +308,54 @@ func (c *TCPConn) GetSecret() ([32]byte, error) {
 
 func (c *TCPConn) SetSecret(secret [32]byte) {
 	c.secret = base64.StdEncoding.EncodeToString(secret[:])
+	c.SetCipher(NewStaticCipher(secret))
+}
+
+func (c *TCPConn) GetCipher() (Cipher, error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if c.cipher == nil {
+		return nil, errors.New("cipher has not been set")
+	}
+	return c.cipher, nil
+}
+
+func (c *TCPConn) SetCipher(cipher Cipher) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.cipher = cipher
+}
+
+func (c *TCPConn) GetHandshake() *Handshake {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.handshake
+}
+
+func (c *TCPConn) SetHandshake(h *Handshake) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.handshake = h
+}
+
+func (c *TCPConn) GetReliable() *Reliable {
+	return c.reliable
+}
+
+func (c *TCPConn) GetMux() *Mux {
+	return c.mux
+}
+
+func (c *TCPConn) GetLiveness() *Liveness {
+	return c.liveness
 }
 
 func NewTCPConn(c *net.TCPConn) *TCPConn {
-	return &TCPConn{C: c}
+	conn := &TCPConn{C: c, m: &sync.RWMutex{}}
+	conn.reliable = NewReliable(conn.write)
+	conn.mux = NewMux(conn)
+	conn.liveness = NewLiveness()
+	return conn
 }
 
 type Conns map[string]Conn
@@ -165,6 +371,63 @@ func (e Endpoint) String() string {
 
 type Blocks map[string]cipher.Block
 
+// Rekey is exchanged by peers to rotate the keys of a RotatingCipher
+type Rekey struct {
+	Epoch   uint32 `json:"epoch"`
+	Key     string `json:"key,omitempty"`
+	Reply   bool   `json:"reply,omitempty"`
+	Confirm bool   `json:"confirm,omitempty"`
+}
+
+// Chat is a line of text sent between peers
+type Chat struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+// receipt states
+const (
+	Delivered = "delivered"
+	Read      = "read"
+)
+
+// Receipt acknowledges that the chat message with the ID was delivered to
+// the peer or displayed to the user
+type Receipt struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+}
+
+// TypingSignal is active while the user is entering a message
+const TypingSignal = "typing"
+
+// SignalTimeout is how long an active signal should be shown without being
+// refreshed, signals are unreliable so the one clearing it may be lost
+const SignalTimeout = 5 * time.Second
+
+// Signal is ephemeral state shared with the peer such as whether the user is
+// typing
+type Signal struct {
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+}
+
+// Introduction is the content of an establish message, the peer to punch
+// through to and when to start
+type Introduction struct {
+	Peer `mapstructure:",squash"`
+	// PunchAt is when both peers start punching in unix milliseconds on the
+	// receiver's clock, zero to start right away
+	PunchAt int64 `json:"punchAt,omitempty"`
+}
+
+// ClockSample is a reading of the server's and a client's clocks in unix
+// milliseconds. The server sends its time, the client answers with its own.
+type ClockSample struct {
+	Server int64 `json:"server"`
+	Client int64 `json:"client,omitempty"`
+}
+
 type Registration struct {
 	Username  string `json:"username"`
 	PublicKey string `json:"publicKey"`
@@ -189,13 +452,100 @@ func NewHistory(f *os.File) *History {
 	}
 }
 
+type VerifiedPeer struct {
+	ID         string    `json:"id"`
+	Username   string    `json:"username"`
+	PublicKey  string    `json:"publicKey,omitempty"`
+	VerifiedAt time.Time `json:"verifiedAt"`
+}
+
+// VerifiedPeers is a file backed set of peers whose short authentication
+// string the user has compared out of band
+type VerifiedPeers struct {
+	path  string
+	peers map[string]VerifiedPeer
+	m     *sync.RWMutex
+}
+
+func (v *VerifiedPeers) IsVerified(id string) bool {
+	v.m.RLock()
+	defer v.m.RUnlock()
+	_, ok := v.peers[id]
+	return ok
+}
+
+func (v *VerifiedPeers) Get(id string) (VerifiedPeer, bool) {
+	v.m.RLock()
+	defer v.m.RUnlock()
+	p, ok := v.peers[id]
+	return p, ok
+}
+
+func (v *VerifiedPeers) Add(p *Peer) error {
+	v.m.Lock()
+	defer v.m.Unlock()
+	v.peers[p.ID] = VerifiedPeer{
+		ID:         p.ID,
+		Username:   p.Username,
+		PublicKey:  p.PublicKey,
+		VerifiedAt: time.Now(),
+	}
+
+	b, err := json.MarshalIndent(v.peers, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(v.path, b, 0600)
+}
+
+func NewVerifiedPeers(path string) (*VerifiedPeers, error) {
+	v := &VerifiedPeers{
+		path:  path,
+		peers: make(map[string]VerifiedPeer),
+		m:     &sync.RWMutex{},
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return v, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &v.peers)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
 type Message struct {
 	Type    string      `json:"type"`
 	PeerID  string      `json:"peerID,omitempty"`
 	Error   string      `json:"error,omitempty"`
 	Content interface{} `json:"data,omitempty"`
-	Encrypt bool        `json:"-"`
-	addr    *net.UDPAddr
+	Seq     uint64      `json:"seq,omitempty"`
+	Ack     uint64      `json:"ack,omitempty"`
+	Window  int         `json:"window,omitempty"`
+	// the machine readable side of Error, see ProtocolError. RetryAfter is
+	// in milliseconds.
+	Code       ErrorCode         `json:"code,omitempty"`
+	RetryAfter int64             `json:"retryAfter,omitempty"`
+	Details    map[string]string `json:"details,omitempty"`
+	Encrypt    bool              `json:"-"`
+	Reliable   bool              `json:"-"`
+	Bulk       bool              `json:"-"`
+	// TTL sends the packets of the message with this IP TTL instead of the
+	// socket's
+	TTL  int `json:"-"`
+	addr *net.UDPAddr
+	// set by MessageIn when the message arrived encrypted
+	encrypted bool
+}
+
+func (m *Message) WasEncrypted() bool {
+	return m.encrypted
 }
 
 func (m *Message) GetAddr() *net.UDPAddr {
@@ -226,6 +576,15 @@ func (p *Peer) GetPublicKey() ([32]byte, error) {
 	return key, nil
 }
 
+// GetKeyPair returns the static key pair the peer authenticates with
+func (p *Peer) GetKeyPair() (*KeyPair, error) {
+	pub, err := p.GetPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{Private: p.PrivateKey, Public: pub}, nil
+}
+
 func (p *Peer) SetPublicKey(key [32]byte) {
 	p.PublicKey = base64.StdEncoding.EncodeToString(key[:])
 }
@@ -0,0 +1,502 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// StreamWindow is how many bytes a stream buffers for the reader. The
+	// writer may only send that much before the reader grants more credit.
+	StreamWindow = 256 * 1024
+	// MaxAcceptBacklog is how many streams opened by the peer may wait for
+	// Accept, more are reset
+	MaxAcceptBacklog = 16
+	// MaxPacketSize is the largest datagram, larger ones are fragmented and
+	// lost entirely if any fragment is
+	MaxPacketSize = 65507
+	// MaxQueuedPackets is how many received datagrams wait to be read before
+	// new ones are dropped
+	MaxQueuedPackets = 256
+)
+
+// frame kinds
+const (
+	frameOpen   = "open"
+	frameData   = "data"
+	frameWindow = "window"
+	frameClose  = "close"
+	frameReset  = "reset"
+)
+
+var (
+	ErrStreamReset = errors.New("stream was reset")
+	ErrMuxClosed   = errors.New("stream multiplexer is closed")
+)
+
+// Frame is the content of a stream message
+type Frame struct {
+	Stream uint32 `json:"stream"`
+	Kind   string `json:"kind"`
+	Name   string `json:"name,omitempty"`
+	Data   string `json:"data,omitempty"`
+	Credit int    `json:"credit,omitempty"`
+}
+
+// Stream is one of the bidirectional byte streams of a Mux. Close ends the
+// writing half, the stream is forgotten once both peers have closed it.
+type Stream struct {
+	ID   uint32
+	Name string
+	mux  *Mux
+	// receive state
+	buf      bytes.Buffer
+	consumed int
+	eof      bool
+	discard  bool
+	// send state
+	credit int
+	closed bool
+	reset  bool
+	cond   *sync.Cond
+	// zero when there is no deadline
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// setDeadline stores the deadline and wakes waiters when it passes
+func (s *Stream) setDeadline(deadline *time.Time, timer **time.Timer, t time.Time) {
+	m := s.mux
+	m.m.Lock()
+	defer m.m.Unlock()
+	*deadline = t
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	if !t.IsZero() {
+		*timer = time.AfterFunc(time.Until(t), func() {
+			m.m.Lock()
+			s.cond.Broadcast()
+			m.m.Unlock()
+		})
+	}
+	s.cond.Broadcast()
+}
+
+// SetReadDeadline makes blocked and future Reads fail after t, the zero
+// time removes the deadline
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.setDeadline(&s.readDeadline, &s.readTimer, t)
+	return nil
+}
+
+// SetWriteDeadline makes Writes that wait for credit fail after t, the zero
+// time removes the deadline
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.setDeadline(&s.writeDeadline, &s.writeTimer, t)
+	return nil
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+// Read reads data the peer wrote to the stream. It returns io.EOF once the
+// peer has closed the stream and everything has been read.
+func (s *Stream) Read(p []byte) (int, error) {
+	m := s.mux
+	m.m.Lock()
+	for s.buf.Len() == 0 && !s.eof && !s.reset && !s.discard && !expired(s.readDeadline) {
+		s.cond.Wait()
+	}
+	if s.reset {
+		m.m.Unlock()
+		return 0, ErrStreamReset
+	}
+	if s.discard {
+		m.m.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	if s.buf.Len() == 0 && !s.eof {
+		m.m.Unlock()
+		return 0, os.ErrDeadlineExceeded
+	}
+	if s.buf.Len() == 0 {
+		m.m.Unlock()
+		return 0, io.EOF
+	}
+
+	n, _ := s.buf.Read(p)
+	credit := s.consume(n)
+	m.m.Unlock()
+
+	if credit > 0 {
+		m.send(&Frame{Stream: s.ID, Kind: frameWindow, Credit: credit}, false)
+	}
+	return n, nil
+}
+
+// consume records that n bytes left the window and returns the credit to
+// grant the peer, which is done once half the window has been consumed. The
+// mux lock must be held.
+func (s *Stream) consume(n int) int {
+	s.consumed += n
+	if s.consumed < StreamWindow/2 {
+		return 0
+	}
+	credit := s.consumed
+	s.consumed = 0
+	return credit
+}
+
+// Write sends p to the peer, blocking while the peer's window is full
+func (s *Stream) Write(p []byte) (int, error) {
+	m := s.mux
+	written := 0
+	for written < len(p) {
+		m.m.Lock()
+		for s.credit == 0 && !s.closed && !s.reset && !expired(s.writeDeadline) {
+			s.cond.Wait()
+		}
+		if s.reset {
+			m.m.Unlock()
+			return written, ErrStreamReset
+		}
+		if s.closed {
+			m.m.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if expired(s.writeDeadline) {
+			m.m.Unlock()
+			return written, os.ErrDeadlineExceeded
+		}
+
+		n := len(p) - written
+		if n > s.credit {
+			n = s.credit
+		}
+		if n > ChunkSize {
+			n = ChunkSize
+		}
+		s.credit -= n
+		deadline := s.writeDeadline
+		m.m.Unlock()
+
+		err := m.sendBefore(&Frame{
+			Stream: s.ID,
+			Kind:   frameData,
+			Data:   base64.StdEncoding.EncodeToString(p[written : written+n]),
+		}, true, deadline)
+		if err != nil {
+			// the data was not sent so the peer's window still has room for it
+			m.m.Lock()
+			s.credit += n
+			m.m.Unlock()
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close tells the peer no more data will be written
+func (s *Stream) Close() error {
+	m := s.mux
+	m.m.Lock()
+	if s.closed || s.reset {
+		m.m.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.cond.Broadcast()
+	m.forget(s)
+	m.m.Unlock()
+
+	return m.send(&Frame{Stream: s.ID, Kind: frameClose}, true)
+}
+
+// CloseRead stops reading from the stream. Unread and future data from the
+// peer is discarded while the peer is still granted credit.
+func (s *Stream) CloseRead() error {
+	m := s.mux
+	m.m.Lock()
+	if s.discard || s.reset {
+		m.m.Unlock()
+		return nil
+	}
+	s.discard = true
+	credit := s.consume(s.buf.Len())
+	s.buf.Reset()
+	s.cond.Broadcast()
+	m.m.Unlock()
+
+	if credit > 0 {
+		return m.send(&Frame{Stream: s.ID, Kind: frameWindow, Credit: credit}, false)
+	}
+	return nil
+}
+
+// Reset aborts the stream in both directions, unread data is discarded
+func (s *Stream) Reset() error {
+	m := s.mux
+	m.m.Lock()
+	if s.reset {
+		m.m.Unlock()
+		return nil
+	}
+	s.abort()
+	m.m.Unlock()
+
+	return m.send(&Frame{Stream: s.ID, Kind: frameReset}, false)
+}
+
+// abort marks the stream reset, the mux lock must be held
+func (s *Stream) abort() {
+	s.reset = true
+	s.buf.Reset()
+	s.cond.Broadcast()
+	delete(s.mux.streams, s.ID)
+}
+
+// Mux carries many independent streams and unreliable datagrams over a
+// single peer Conn. Frames are sent reliably and encrypted, stream data goes
+// behind interactive messages.
+type Mux struct {
+	conn      Conn
+	nextID    uint32
+	streams   map[uint32]*Stream
+	accept    chan *Stream
+	datagrams chan []byte
+	closed    bool
+	done      chan struct{}
+	m         *sync.Mutex
+}
+
+func (m *Mux) send(f *Frame, bulk bool) error {
+	return m.sendBefore(f, bulk, time.Time{})
+}
+
+// sendBefore is send but stops waiting for room in the reliable layer at the
+// deadline
+func (m *Mux) sendBefore(f *Frame, bulk bool, deadline time.Time) error {
+	return m.conn.GetReliable().SendBefore(&Message{
+		Type:     "stream",
+		Content:  f,
+		Encrypt:  true,
+		Reliable: true,
+		Bulk:     bulk,
+	}, deadline)
+}
+
+func (m *Mux) newStream(id uint32, name string) *Stream {
+	s := &Stream{
+		ID:     id,
+		Name:   name,
+		mux:    m,
+		credit: StreamWindow,
+		cond:   sync.NewCond(m.m),
+	}
+	m.streams[id] = s
+	return s
+}
+
+// forget drops a stream once both halves are closed, the mux lock must be
+// held
+func (m *Mux) forget(s *Stream) {
+	if s.closed && s.eof {
+		delete(m.streams, s.ID)
+	}
+}
+
+// peerStreamID reports whether the ID is one the peer may open a stream with,
+// the IDs of the handshake initiator are odd and those of the responder even
+func (m *Mux) peerStreamID(id uint32) bool {
+	h := m.conn.GetHandshake()
+	if h == nil || id == 0 {
+		return false
+	}
+	return (id%2 == 1) != h.Initiator()
+}
+
+// Open starts a new stream, name tells the peer what the stream is for
+func (m *Mux) Open(name string) (*Stream, error) {
+	h := m.conn.GetHandshake()
+	if h == nil || !h.Complete() {
+		return nil, errors.New("streams need an established peer session")
+	}
+
+	m.m.Lock()
+	if m.closed {
+		m.m.Unlock()
+		return nil, ErrMuxClosed
+	}
+	// the handshake initiator uses odd IDs and the responder even ones so
+	// the peers never pick the same ID
+	if m.nextID == 0 {
+		m.nextID = 2
+		if h.Initiator() {
+			m.nextID = 1
+		}
+	}
+	id := m.nextID
+	m.nextID += 2
+	s := m.newStream(id, name)
+	m.m.Unlock()
+
+	err := m.send(&Frame{Stream: id, Kind: frameOpen, Name: name}, false)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Accept waits for the peer to open a stream
+func (m *Mux) Accept() (*Stream, error) {
+	s, ok := <-m.accept
+	if !ok {
+		return nil, ErrMuxClosed
+	}
+	return s, nil
+}
+
+// SendDatagram sends b to the peer without retransmission or ordering
+func (m *Mux) SendDatagram(b []byte) error {
+	if len(b) > MaxPacketSize {
+		return fmt.Errorf("datagram of %d bytes is larger than %d bytes", len(b), MaxPacketSize)
+	}
+	return m.conn.Send(&Message{
+		Type:    "datagram",
+		Content: base64.StdEncoding.EncodeToString(b),
+		Encrypt: true,
+	})
+}
+
+// HandleDatagram queues a datagram received from the peer, it is dropped
+// when the queue is full
+func (m *Mux) HandleDatagram(b []byte) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	if m.closed {
+		return
+	}
+	select {
+	case m.datagrams <- b:
+	default:
+	}
+}
+
+// Handle processes a frame received from the peer. It never blocks.
+func (m *Mux) Handle(f *Frame) error {
+	m.m.Lock()
+	if m.closed {
+		m.m.Unlock()
+		return nil
+	}
+
+	s, ok := m.streams[f.Stream]
+	if f.Kind == frameOpen {
+		if ok || !m.peerStreamID(f.Stream) {
+			// the stream with the ID is reset on both sides
+			if ok {
+				s.abort()
+			}
+			m.m.Unlock()
+			err := m.send(&Frame{Stream: f.Stream, Kind: frameReset}, false)
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("peer opened stream %d which is not its to open", f.Stream)
+		}
+		s = m.newStream(f.Stream, f.Name)
+		select {
+		case m.accept <- s:
+			m.m.Unlock()
+		default:
+			s.abort()
+			m.m.Unlock()
+			return m.send(&Frame{Stream: f.Stream, Kind: frameReset}, false)
+		}
+		return nil
+	}
+	if !ok {
+		// frames can still arrive for a stream that was reset
+		m.m.Unlock()
+		return nil
+	}
+
+	var reset bool
+	var credit int
+	switch f.Kind {
+	case frameData:
+		b, err := base64.StdEncoding.DecodeString(f.Data)
+		// a peer that ignores the window is broken or hostile
+		if err != nil || s.eof || s.buf.Len()+len(b) > StreamWindow {
+			s.abort()
+			reset = true
+			break
+		}
+		if s.discard {
+			credit = s.consume(len(b))
+			break
+		}
+		s.buf.Write(b)
+	case frameWindow:
+		s.credit += f.Credit
+	case frameClose:
+		s.eof = true
+		m.forget(s)
+	case frameReset:
+		s.abort()
+	}
+	s.cond.Broadcast()
+	m.m.Unlock()
+
+	if reset {
+		return m.send(&Frame{Stream: f.Stream, Kind: frameReset}, false)
+	}
+	if credit > 0 {
+		return m.send(&Frame{Stream: f.Stream, Kind: frameWindow, Credit: credit}, false)
+	}
+	return nil
+}
+
+// Close resets every stream and stops accepting new ones
+func (m *Mux) Close() {
+	m.m.Lock()
+	defer m.m.Unlock()
+	if m.closed {
+		return
+	}
+	m.closed = true
+	for _, s := range m.streams {
+		s.abort()
+	}
+	close(m.accept)
+	close(m.done)
+}
+
+// NewMux returns a Mux that sends its frames over conn
+func NewMux(conn Conn) *Mux {
+	return &Mux{
+		conn:      conn,
+		streams:   make(map[uint32]*Stream),
+		accept:    make(chan *Stream, MaxAcceptBacklog),
+		datagrams: make(chan []byte, MaxQueuedPackets),
+		done:      make(chan struct{}),
+		m:         &sync.Mutex{},
+	}
+}
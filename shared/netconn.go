@@ -0,0 +1,207 @@
+package shared
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// PeerAddr is the address of one end of a peer session
+type PeerAddr struct {
+	ID   string
+	Addr net.Addr
+}
+
+func (a *PeerAddr) Network() string {
+	return "p2p"
+}
+
+func (a *PeerAddr) String() string {
+	if a.Addr == nil {
+		return a.ID
+	}
+	return a.ID + "@" + a.Addr.String()
+}
+
+// StreamConn is a Stream that satisfies net.Conn. Unlike Stream.Close,
+// Close ends both directions.
+type StreamConn struct {
+	*Stream
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *StreamConn) Close() error {
+	c.Stream.CloseRead()
+	return c.Stream.Close()
+}
+
+func (c *StreamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *StreamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func NewStreamConn(s *Stream, local, remote net.Addr) *StreamConn {
+	return &StreamConn{
+		Stream: s,
+		local:  local,
+		remote: remote,
+	}
+}
+
+// StreamListener accepts the streams the peer opens as net.Conns
+type StreamListener struct {
+	mux    *Mux
+	local  net.Addr
+	remote net.Addr
+	done   chan struct{}
+	once   *sync.Once
+}
+
+func (l *StreamListener) Accept() (net.Conn, error) {
+	select {
+	case s, ok := <-l.mux.accept:
+		if !ok {
+			return nil, ErrMuxClosed
+		}
+		return NewStreamConn(s, l.local, l.remote), nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting streams, streams that were accepted stay open
+func (l *StreamListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *StreamListener) Addr() net.Addr {
+	return l.local
+}
+
+func NewStreamListener(mux *Mux, local, remote net.Addr) *StreamListener {
+	return &StreamListener{
+		mux:    mux,
+		local:  local,
+		remote: remote,
+		done:   make(chan struct{}),
+		once:   &sync.Once{},
+	}
+}
+
+// PacketConn sends and receives the unreliable datagrams of a Mux as a
+// net.PacketConn. Its only peer is the remote end of the session.
+type PacketConn struct {
+	mux      *Mux
+	local    net.Addr
+	remote   net.Addr
+	deadline time.Time
+	changed  chan struct{}
+	done     chan struct{}
+	once     *sync.Once
+	m        *sync.Mutex
+}
+
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.m.Lock()
+		deadline := c.deadline
+		changed := c.changed
+		c.m.Unlock()
+
+		n, ok, err := c.read(b, deadline, changed)
+		if ok {
+			return n, c.remote, err
+		}
+		// the deadline moved, wait again with the new one
+	}
+}
+
+// read waits for a datagram until the deadline, it is not ok when the
+// deadline changed while waiting
+func (c *PacketConn) read(b []byte, deadline time.Time, changed chan struct{}) (int, bool, error) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case d := <-c.mux.datagrams:
+		// like a UDP socket, the rest of a long datagram is discarded
+		return copy(b, d), true, nil
+	case <-c.mux.done:
+		return 0, true, ErrMuxClosed
+	case <-c.done:
+		return 0, true, net.ErrClosed
+	case <-timeout:
+		return 0, true, os.ErrDeadlineExceeded
+	case <-changed:
+		return 0, false, nil
+	}
+}
+
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	if addr != nil && addr.String() != c.remote.String() {
+		return 0, errors.New("a peer session can only send to its peer")
+	}
+
+	err := c.mux.SendDatagram(b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *PacketConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *PacketConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline makes blocked and future reads fail after t, the zero time
+// removes the deadline
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.deadline = t
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline does nothing as writes never block
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func NewPacketConn(mux *Mux, local, remote net.Addr) *PacketConn {
+	return &PacketConn{
+		mux:     mux,
+		local:   local,
+		remote:  remote,
+		changed: make(chan struct{}),
+		done:    make(chan struct{}),
+		once:    &sync.Once{},
+		m:       &sync.Mutex{},
+	}
+}
@@ -0,0 +1,131 @@
+package shared
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// PunchStrategy decides how a client punches through to a new peer. Every
+// attempt sends the pending handshake message, or a bare punch while the
+// peer has not started the handshake, and then waits for the next interval.
+type PunchStrategy struct {
+	// Attempts is how many attempts are made before giving up
+	Attempts int
+	// Intervals are the waits after each attempt, the last one is repeated
+	// for the attempts that follow
+	Intervals []time.Duration
+	// Burst is how many copies of the first attempt are sent back to back
+	Burst int
+	// Jitter is the most that is added at random to each wait
+	Jitter time.Duration
+	// Deadline bounds the whole punch, zero leaves it to Attempts
+	Deadline time.Duration
+	// LowTTL is the TTL of the bare punches the first LowTTLAttempts
+	// attempts send instead. They open the client's own NAT mapping but
+	// expire before they reach the peer's NAT, which could otherwise
+	// blacklist the client for knocking before the peer punched out. Zero
+	// sends every attempt with the normal TTL.
+	LowTTL         int
+	LowTTLAttempts int
+}
+
+// DefaultPunchStrategy makes five attempts three seconds apart
+var DefaultPunchStrategy = PunchStrategy{
+	Attempts:  5,
+	Intervals: []time.Duration{3 * time.Second},
+	Burst:     1,
+	// LowTTL stays off, it needs a TTL below the hops to the peer's NAT
+	LowTTLAttempts: 1,
+}
+
+const (
+	// DefaultPunchMargin is how much later than the slower peer can be
+	// reached the rendezvous server has both peers start punching
+	DefaultPunchMargin = 100 * time.Millisecond
+	// MaxPunchDelay is the longest a client waits for the moment the server
+	// picked, a later one means the clocks were not measured well
+	MaxPunchDelay = 5 * time.Second
+)
+
+// PunchMode is how the packets of a punch attempt are sent
+type PunchMode string
+
+const (
+	// PunchNormal attempts are sent with the normal TTL
+	PunchNormal PunchMode = "normal"
+	// PunchLowTTL attempts are bare punches sent with the strategy's LowTTL
+	PunchLowTTL PunchMode = "low TTL"
+)
+
+// Mode returns how the attempt with the index is sent
+func (p PunchStrategy) Mode(attempt int) PunchMode {
+	if p.LowTTL > 0 && attempt < p.LowTTLAttempts {
+		return PunchLowTTL
+	}
+	return PunchNormal
+}
+
+// Wait returns how long to wait after the attempt with the index, jitter
+// included
+func (p PunchStrategy) Wait(attempt int) time.Duration {
+	var d time.Duration
+	if n := len(p.Intervals); n > 0 {
+		if attempt >= n {
+			attempt = n - 1
+		}
+		d = p.Intervals[attempt]
+	}
+	if p.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(p.Jitter)))
+	}
+	return d
+}
+
+// ParseIntervals reads a comma separated list of durations such as
+// "100ms,500ms,3s"
+func ParseIntervals(s string) ([]time.Duration, error) {
+	var intervals []time.Duration
+	for _, f := range strings.Split(s, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(f))
+		if err != nil {
+			return nil, err
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("interval %s is negative", d)
+		}
+		intervals = append(intervals, d)
+	}
+	return intervals, nil
+}
+
+// PunchOutcome is how punching through to a peer ended
+type PunchOutcome string
+
+const (
+	// PunchConnected means the handshake completed
+	PunchConnected PunchOutcome = "connected"
+	// PunchExhausted means every attempt was made without an answer
+	PunchExhausted PunchOutcome = "exhausted"
+	// PunchTimedOut means the deadline of the strategy passed
+	PunchTimedOut PunchOutcome = "timed out"
+	// PunchCancelled means the context was cancelled or the session ended
+	PunchCancelled PunchOutcome = "cancelled"
+	// PunchFailed means the handshake could not go on, see Err
+	PunchFailed PunchOutcome = "failed"
+)
+
+// PunchResult reports how punching through to the peer of a session went
+type PunchResult struct {
+	Outcome PunchOutcome
+	// Mode is how the attempt just before the outcome was sent, for a
+	// connected punch the mode that got through
+	Mode PunchMode
+	// Attempts is how many attempts were sent, LowTTLAttempts how many of
+	// them were sent with the strategy's LowTTL
+	Attempts       int
+	LowTTLAttempts int
+	Elapsed        time.Duration
+	Err            error
+}
@@ -0,0 +1,193 @@
+package shared
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/wilfreddenton/crypto"
+)
+
+// MaxSkip is the number of message keys a Ratchet will derive ahead of the
+// last message it received to cope with lost or reordered packets
+const MaxSkip = 1000
+
+// Cipher seals and opens the encrypted payloads carried by a Conn
+type Cipher interface {
+	Seal([]byte) ([]byte, error)
+	Open([]byte) ([]byte, error)
+	Session() SessionID
+}
+
+type staticCipher struct {
+	secret [32]byte
+}
+
+func (c *staticCipher) Seal(b []byte) ([]byte, error) {
+	return crypto.Encrypt(b, c.secret)
+}
+
+func (c *staticCipher) Open(b []byte) ([]byte, error) {
+	return crypto.Decrypt(b, c.secret)
+}
+
+func (c *staticCipher) Session() SessionID {
+	return NewSessionID(c.secret)
+}
+
+// NewStaticCipher returns a Cipher that encrypts every message with the same
+// secret. It is used for the connection to the rendezvous server.
+func NewStaticCipher(secret [32]byte) Cipher {
+	return &staticCipher{secret: secret}
+}
+
+type KeyPair struct {
+	Private [32]byte
+	Public  [32]byte
+}
+
+func GenKeyPair() (*KeyPair, error) {
+	pri, pub, err := crypto.GenKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{Private: pri, Public: pub}, nil
+}
+
+func deriveKey(secret []byte, info string) [32]byte {
+	var key [32]byte
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(info))
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+// step advances a chain key returning the message key for the current
+// position and the chain key for the next one
+func step(chain [32]byte) ([32]byte, [32]byte) {
+	return deriveKey(chain[:], "message key"), deriveKey(chain[:], "chain key")
+}
+
+// Ratchet is a Cipher that advances a symmetric key chain in each direction
+// after every message. Message keys are discarded once used so a compromise
+// of the current state does not reveal past messages.
+type Ratchet struct {
+	root      [32]byte
+	session   SessionID
+	initiator bool
+	send      [32]byte
+	recv      [32]byte
+	sendN     uint64
+	recvN     uint64
+	skipped   map[uint64][32]byte
+	m         *sync.Mutex
+}
+
+func (r *Ratchet) Seal(b []byte) ([]byte, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	var key [32]byte
+	key, r.send = step(r.send)
+	n := r.sendN
+	r.sendN += 1
+
+	ct, err := crypto.Encrypt(b, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// prefix the counter so the receiver can find the right message key
+	out := make([]byte, 8, 8+len(ct))
+	binary.BigEndian.PutUint64(out, n)
+	return append(out, ct...), nil
+}
+
+func (r *Ratchet) Open(b []byte) ([]byte, error) {
+	if len(b) < 8 {
+		return nil, errors.New("ratchet payload is too short")
+	}
+	n := binary.BigEndian.Uint64(b[:8])
+	ct := b[8:]
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	// a message that was skipped earlier
+	if key, ok := r.skipped[n]; ok {
+		pt, err := crypto.Decrypt(ct, key)
+		if err != nil {
+			return nil, err
+		}
+		delete(r.skipped, n)
+		return pt, nil
+	}
+
+	if n < r.recvN {
+		return nil, errors.New("message key has already been used")
+	}
+	if n-r.recvN > MaxSkip {
+		return nil, errors.New("too many skipped messages")
+	}
+
+	// derive the keys up to n without committing them until the message
+	// decrypts so a forged counter cannot advance the chain
+	chain := r.recv
+	skipped := make(map[uint64][32]byte)
+	var key [32]byte
+	for i := r.recvN; i < n; i += 1 {
+		key, chain = step(chain)
+		skipped[i] = key
+	}
+	key, chain = step(chain)
+
+	pt, err := crypto.Decrypt(ct, key)
+	if err != nil {
+		return nil, err
+	}
+
+	r.recv = chain
+	r.recvN = n + 1
+	for i, k := range skipped {
+		r.skipped[i] = k
+	}
+
+	// forget keys that are too old to be useful
+	for i := range r.skipped {
+		if r.recvN-i > MaxSkip {
+			delete(r.skipped, i)
+		}
+	}
+
+	return pt, nil
+}
+
+func (r *Ratchet) Session() SessionID {
+	return r.session
+}
+
+// Next derives the Ratchet of the following epoch by mixing a fresh shared
+// secret into the root key
+func (r *Ratchet) Next(secret [32]byte) *Ratchet {
+	return NewRatchet(deriveKey(append(r.root[:], secret[:]...), "rekey root key"), r.initiator)
+}
+
+func NewRatchet(root [32]byte, initiator bool) *Ratchet {
+	a := deriveKey(root[:], "initiator chain")
+	b := deriveKey(root[:], "responder chain")
+	if !initiator {
+		a, b = b, a
+	}
+
+	return &Ratchet{
+		root:      root,
+		session:   NewSessionID(root),
+		initiator: initiator,
+		send:      a,
+		recv:      b,
+		skipped:   make(map[uint64][32]byte),
+		m:         &sync.Mutex{},
+	}
+}
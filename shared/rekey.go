@@ -0,0 +1,232 @@
+package shared
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/wilfreddenton/crypto"
+)
+
+// RekeyPolicy decides when a RotatingCipher asks for new keys. A zero
+// Messages or Interval disables that trigger.
+type RekeyPolicy struct {
+	Messages uint64
+	Interval time.Duration
+	// how long packets sealed under the previous keys are still accepted
+	Grace time.Duration
+	// how long to wait for a reply before the rekey request is sent again
+	Retry time.Duration
+}
+
+var DefaultRekeyPolicy = RekeyPolicy{
+	Messages: 1000,
+	Interval: 10 * time.Minute,
+	Grace:    10 * time.Second,
+	Retry:    3 * time.Second,
+}
+
+// RotatingCipher is a Cipher whose keys are replaced by an exchange of rekey
+// messages. Each payload is prefixed with the epoch of the keys that sealed
+// it.
+//
+// The peer that starts a rekey switches both directions to the new epoch as
+// soon as it receives the reply and confirms the switch with a message sealed
+// under the new keys. The replying peer keeps sending under the old epoch
+// until the first packet of the new epoch arrives. The previous keys remain
+// valid for a grace period to accept packets that were in flight.
+type RotatingCipher struct {
+	policy       RekeyPolicy
+	session      SessionID
+	epoch        uint32
+	current      *Ratchet
+	next         *Ratchet
+	prev         *Ratchet
+	prevExpiry   time.Time
+	started      time.Time
+	sent         uint64
+	pending      *KeyPair
+	pendingSince time.Time
+	reply        *Rekey
+	m            *sync.Mutex
+}
+
+func (c *RotatingCipher) promote() {
+	c.prev, c.prevExpiry = c.current, time.Now().Add(c.policy.Grace)
+	c.current, c.next = c.next, nil
+	c.epoch += 1
+	c.started = time.Now()
+	c.sent = 0
+	c.reply = nil
+}
+
+func (c *RotatingCipher) Seal(b []byte) ([]byte, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	ct, err := c.current.Seal(b)
+	if err != nil {
+		return nil, err
+	}
+	c.sent += 1
+
+	out := make([]byte, 4, 4+len(ct))
+	binary.BigEndian.PutUint32(out, c.epoch)
+	return append(out, ct...), nil
+}
+
+func (c *RotatingCipher) Open(b []byte) ([]byte, error) {
+	if len(b) < 4 {
+		return nil, errors.New("rotating cipher payload is too short")
+	}
+	epoch := binary.BigEndian.Uint32(b[:4])
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	switch {
+	case epoch == c.epoch:
+		return c.current.Open(b[4:])
+	case epoch == c.epoch+1 && c.next != nil:
+		pt, err := c.next.Open(b[4:])
+		if err != nil {
+			return nil, err
+		}
+		// the peer is sending under the new keys so switch over as well
+		c.promote()
+		return pt, nil
+	case epoch+1 == c.epoch && c.prev != nil && time.Now().Before(c.prevExpiry):
+		return c.prev.Open(b[4:])
+	}
+	return nil, fmt.Errorf("no keys for epoch %d", epoch)
+}
+
+// Session stays the same across rekeys so that the session can still be
+// found by the ID it started with
+func (c *RotatingCipher) Session() SessionID {
+	return c.session
+}
+
+// NeedsRekey reports whether the policy asks for new keys or an outstanding
+// request has gone unanswered for too long
+func (c *RotatingCipher) NeedsRekey() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.pending != nil {
+		return c.policy.Retry > 0 && time.Since(c.pendingSince) >= c.policy.Retry
+	}
+	if c.next != nil {
+		return false
+	}
+	return (c.policy.Messages > 0 && c.sent >= c.policy.Messages) ||
+		(c.policy.Interval > 0 && time.Since(c.started) >= c.policy.Interval)
+}
+
+// StartRekey returns the request that asks the peer for new keys. Calling it
+// again before the reply arrives returns the same request.
+func (c *RotatingCipher) StartRekey() (*Rekey, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.pending == nil {
+		kp, err := GenKeyPair()
+		if err != nil {
+			return nil, err
+		}
+		c.pending = kp
+	}
+	c.pendingSince = time.Now()
+
+	return &Rekey{
+		Epoch: c.epoch + 1,
+		Key:   base64.StdEncoding.EncodeToString(c.pending.Public[:]),
+	}, nil
+}
+
+func decodeKey(s string) ([32]byte, error) {
+	var key [32]byte
+	bs, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return key, err
+	}
+	if len(bs) != 32 {
+		return key, errors.New("keys must be 32 bytes")
+	}
+	copy(key[:], bs)
+	return key, nil
+}
+
+// HandleRekey processes a rekey message from the peer and returns the
+// message that should be sent back, if any
+func (c *RotatingCipher) HandleRekey(r *Rekey) (*Rekey, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	// a confirmation only matters for the epoch it was sealed under which
+	// Open has already switched to
+	if r.Confirm {
+		return nil, nil
+	}
+
+	if r.Epoch != c.epoch+1 {
+		// a late duplicate of a rekey that already completed
+		if r.Epoch <= c.epoch {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("rekey to epoch %d but the current epoch is %d", r.Epoch, c.epoch)
+	}
+
+	key, err := decodeKey(r.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Reply {
+		if c.pending == nil {
+			return nil, nil
+		}
+		c.next = c.current.Next(crypto.GenSharedSecret(c.pending.Private, key))
+		c.pending = nil
+		c.promote()
+		return &Rekey{Epoch: c.epoch, Confirm: true}, nil
+	}
+
+	// the request was retransmitted because the reply was lost
+	if c.next != nil {
+		return c.reply, nil
+	}
+
+	// both peers asked for new keys at once, the session initiator wins
+	if c.pending != nil {
+		if c.current.initiator {
+			return nil, nil
+		}
+		c.pending = nil
+	}
+
+	kp, err := GenKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	c.next = c.current.Next(crypto.GenSharedSecret(kp.Private, key))
+	c.reply = &Rekey{
+		Epoch: c.epoch + 1,
+		Key:   base64.StdEncoding.EncodeToString(kp.Public[:]),
+		Reply: true,
+	}
+	return c.reply, nil
+}
+
+func NewRotatingCipher(r *Ratchet, policy RekeyPolicy) *RotatingCipher {
+	return &RotatingCipher{
+		policy:  policy,
+		session: r.Session(),
+		current: r,
+		started: time.Now(),
+		m:       &sync.Mutex{},
+	}
+}
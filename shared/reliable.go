@@ -0,0 +1,382 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrReliableClosed is returned by Send once the session has ended
+var ErrReliableClosed = errors.New("reliable delivery has stopped")
+
+const (
+	initialRTO = time.Second
+	minRTO     = 200 * time.Millisecond
+	maxRTO     = 60 * time.Second
+	// MaxRetransmits is how many times a reliable message is sent again
+	// before it is given up on
+	MaxRetransmits = 8
+	// MaxOutOfOrder caps how far ahead of the next expected message the
+	// receiver buffers. It is also the largest window a receiver advertises.
+	MaxOutOfOrder = 1024
+	// MaxQueued is how many bulk messages may wait for the window before
+	// Send blocks
+	MaxQueued = 256
+	// congestion window bounds, in messages
+	initialWindow = 4
+	initialThresh = 64
+	minimumThresh = 2
+	maximumWindow = MaxOutOfOrder
+)
+
+type inflight struct {
+	m       *Message
+	sent    time.Time
+	retries int
+	rto     time.Duration
+	timer   *time.Timer
+}
+
+// Reliable adds acknowledgements, retransmission, duplicate suppression and
+// in-order delivery to any Conn. Messages opt in with Message.Reliable, all
+// other messages pass through untouched.
+//
+// The number of unacknowledged messages is limited by the smaller of an AIMD
+// congestion window and the window the receiver advertises in its acks.
+// Messages that do not fit wait in a queue where bulk messages go behind
+// interactive ones so that a large transfer does not hold up the chat.
+type Reliable struct {
+	write func(*Message) error
+	// sender state
+	nextSeq  uint64
+	pending  map[uint64]*inflight
+	queue    []*Message
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+	cwnd     float64
+	ssthresh float64
+	rwnd     int
+	recover  uint64
+	space    *sync.Cond
+	fail     func(*Message, error)
+	closed   bool
+	// receiver state
+	expected uint64
+	buffered map[uint64]*Message
+	ready    []*Message
+	draining bool
+	m        *sync.Mutex
+}
+
+// window is the number of messages that may be unacknowledged
+func (r *Reliable) window() int {
+	w := int(r.cwnd)
+	if r.rwnd < w {
+		w = r.rwnd
+	}
+	// keep one message in flight to probe a closed window
+	if w < 1 {
+		w = 1
+	}
+	return w
+}
+
+// flush moves queued messages into flight while the window allows and
+// returns the ones that need to be written
+func (r *Reliable) flush() []*Message {
+	var ms []*Message
+	for len(r.queue) > 0 && len(r.pending) < r.window() {
+		m := r.queue[0]
+		r.queue = r.queue[1:]
+
+		m.Seq = r.nextSeq
+		r.nextSeq += 1
+		seq := m.Seq
+		p := &inflight{m: m, sent: time.Now(), rto: r.rto}
+		r.pending[seq] = p
+		p.timer = time.AfterFunc(p.rto, func() { r.retransmit(seq) })
+		ms = append(ms, m)
+	}
+	r.space.Broadcast()
+	return ms
+}
+
+func (r *Reliable) writeAll(ms []*Message) error {
+	var err error
+	for _, m := range ms {
+		if e := r.write(m); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Send queues the message and sends it until it is acknowledged. Sending a
+// bulk message blocks while the queue is full.
+func (r *Reliable) Send(m *Message) error {
+	return r.SendBefore(m, time.Time{})
+}
+
+// SendBefore is Send but a bulk message stops waiting for room in the queue
+// at the deadline, the zero time waits without one
+func (r *Reliable) SendBefore(m *Message, deadline time.Time) error {
+	r.m.Lock()
+	if r.closed {
+		r.m.Unlock()
+		return ErrReliableClosed
+	}
+	if m.Bulk {
+		if !deadline.IsZero() && len(r.queue) >= MaxQueued {
+			t := time.AfterFunc(time.Until(deadline), func() {
+				r.m.Lock()
+				r.space.Broadcast()
+				r.m.Unlock()
+			})
+			defer t.Stop()
+		}
+		for len(r.queue) >= MaxQueued && !r.closed && !expired(deadline) {
+			r.space.Wait()
+		}
+		if r.closed {
+			r.m.Unlock()
+			return ErrReliableClosed
+		}
+		if len(r.queue) >= MaxQueued {
+			r.m.Unlock()
+			return os.ErrDeadlineExceeded
+		}
+		r.queue = append(r.queue, m)
+	} else {
+		// interactive messages go ahead of any bulk messages
+		i := 0
+		for i < len(r.queue) && !r.queue[i].Bulk {
+			i += 1
+		}
+		r.queue = append(r.queue, nil)
+		copy(r.queue[i+1:], r.queue[i:])
+		r.queue[i] = m
+	}
+	ms := r.flush()
+	r.m.Unlock()
+
+	return r.writeAll(ms)
+}
+
+// OnFail sets what is called when a message is given up on
+func (r *Reliable) OnFail(f func(*Message, error)) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.fail = f
+}
+
+// Close stops retransmitting and makes blocked and future Sends fail
+func (r *Reliable) Close() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	for _, p := range r.pending {
+		p.timer.Stop()
+	}
+	r.pending = make(map[uint64]*inflight)
+	r.queue = nil
+	r.space.Broadcast()
+}
+
+func (r *Reliable) retransmit(seq uint64) {
+	r.m.Lock()
+	p, ok := r.pending[seq]
+	if !ok || r.closed {
+		r.m.Unlock()
+		return
+	}
+	if p.retries >= MaxRetransmits {
+		// the receiver holds everything after the lost message back, so
+		// nothing sent from here on would be delivered either
+		delete(r.pending, seq)
+		fail := r.fail
+		r.m.Unlock()
+		err := fmt.Errorf("peer did not acknowledge %s message %d after %d retransmits", p.m.Type, seq, MaxRetransmits)
+		if fail == nil {
+			log.Print(err)
+			return
+		}
+		fail(p.m, err)
+		return
+	}
+
+	// a loss: halve the threshold and restart from a single message, but
+	// only once for all the messages that were in flight together
+	if seq > r.recover {
+		r.ssthresh = r.cwnd / 2
+		if r.ssthresh < minimumThresh {
+			r.ssthresh = minimumThresh
+		}
+		r.cwnd = 1
+		r.recover = r.nextSeq - 1
+	}
+
+	p.retries += 1
+	p.sent = time.Now()
+	// back off exponentially from the current estimate while the message is
+	// not acknowledged
+	p.rto = r.rto << uint(p.retries)
+	if p.rto > maxRTO || p.rto <= 0 {
+		p.rto = maxRTO
+	}
+	p.timer = time.AfterFunc(p.rto, func() { r.retransmit(seq) })
+	r.m.Unlock()
+
+	r.write(p.m)
+}
+
+// sample updates the retransmission timeout as described in RFC 6298
+func (r *Reliable) sample(rtt time.Duration) {
+	if r.srtt == 0 {
+		r.srtt = rtt
+		r.rttvar = rtt / 2
+	} else {
+		d := r.srtt - rtt
+		if d < 0 {
+			d = -d
+		}
+		r.rttvar = (3*r.rttvar + d) / 4
+		r.srtt = (7*r.srtt + rtt) / 8
+	}
+
+	r.rto = r.srtt + 4*r.rttvar
+	if r.rto < minRTO {
+		r.rto = minRTO
+	}
+	if r.rto > maxRTO {
+		r.rto = maxRTO
+	}
+}
+
+func (r *Reliable) ack(seq uint64, window int) {
+	r.m.Lock()
+	r.rwnd = window
+
+	p, ok := r.pending[seq]
+	if ok {
+		p.timer.Stop()
+		delete(r.pending, seq)
+
+		// Karn's algorithm: only messages sent once give an unambiguous sample
+		if p.retries == 0 {
+			r.sample(time.Since(p.sent))
+		}
+
+		// grow exponentially in slow start then by one message per window
+		if r.cwnd < r.ssthresh {
+			r.cwnd += 1
+		} else {
+			r.cwnd += 1 / r.cwnd
+		}
+		if r.cwnd > maximumWindow {
+			r.cwnd = maximumWindow
+		}
+	}
+
+	ms := r.flush()
+	r.m.Unlock()
+
+	r.writeAll(ms)
+}
+
+// Receive processes a message read from the Conn and passes every message
+// that is ready, in order, to deliver. Acknowledgements are consumed and
+// duplicates are dropped.
+func (r *Reliable) Receive(m *Message, deliver func(*Message)) {
+	if m.Type == "ack" {
+		r.ack(m.Ack, m.Window)
+		return
+	}
+	if m.Seq == 0 {
+		deliver(m)
+		return
+	}
+
+	r.m.Lock()
+	switch {
+	case m.Seq > r.expected && m.Seq-r.expected >= MaxOutOfOrder:
+		// too far ahead, the sender will try again later
+		r.m.Unlock()
+		return
+	case m.Seq < r.expected || r.buffered[m.Seq] != nil:
+		// a duplicate whose ack was lost
+	case m.Seq > r.expected:
+		r.buffered[m.Seq] = m
+	default:
+		r.ready = append(r.ready, m)
+		r.expected += 1
+		for {
+			next, ok := r.buffered[r.expected]
+			if !ok {
+				break
+			}
+			delete(r.buffered, r.expected)
+			r.ready = append(r.ready, next)
+			r.expected += 1
+		}
+	}
+	// advertise how many more messages fit in the receive buffers
+	window := MaxOutOfOrder - len(r.buffered) - len(r.ready)
+	r.m.Unlock()
+
+	// acknowledge with the same protection the message arrived with
+	r.write(&Message{
+		Type:    "ack",
+		Ack:     m.Seq,
+		Window:  window,
+		Encrypt: m.WasEncrypted(),
+	})
+
+	r.drain(deliver)
+}
+
+// drain delivers ready messages one at a time so that messages handled by
+// concurrent receivers keep their order
+func (r *Reliable) drain(deliver func(*Message)) {
+	r.m.Lock()
+	if r.draining {
+		r.m.Unlock()
+		return
+	}
+	r.draining = true
+
+	for len(r.ready) > 0 {
+		m := r.ready[0]
+		r.ready = r.ready[1:]
+		r.m.Unlock()
+		deliver(m)
+		r.m.Lock()
+	}
+
+	r.draining = false
+	r.m.Unlock()
+}
+
+// NewReliable returns a Reliable that sends its messages with write
+func NewReliable(write func(*Message) error) *Reliable {
+	r := &Reliable{
+		write:    write,
+		nextSeq:  1,
+		pending:  make(map[uint64]*inflight),
+		rto:      initialRTO,
+		cwnd:     initialWindow,
+		ssthresh: initialThresh,
+		rwnd:     initialThresh,
+		expected: 1,
+		buffered: make(map[uint64]*Message),
+		m:        &sync.Mutex{},
+	}
+	r.space = sync.NewCond(r.m)
+	return r
+}
@@ -0,0 +1,486 @@
+package shared
+
+import (
+	crand "crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/wilfreddenton/crypto"
+)
+
+// MaxRoomPending is the number of room messages a member holds back while
+// it waits for the messages they depend on or for the group key
+const MaxRoomPending = 1000
+
+// RoomInfo is the member list of a room as the rendezvous server keeps it.
+// The epoch grows with every change of membership.
+type RoomInfo struct {
+	ID      string  `json:"id"`
+	Epoch   uint64  `json:"epoch"`
+	Members []*Peer `json:"members"`
+}
+
+// RoomKey is the group key of an epoch of a room. The member with the lowest
+// ID keeps the room: it picks a new key whenever the membership changes and
+// sends it to every other member over their peer session.
+type RoomKey struct {
+	RoomID string `json:"roomID"`
+	Epoch  uint64 `json:"epoch"`
+	Key    string `json:"key"`
+}
+
+// RoomEnvelope carries a room message sealed with the group key. Members
+// relay the envelopes they have not seen before to the members they are
+// connected to, so a message reaches members that could not punch through
+// to its sender.
+type RoomEnvelope struct {
+	RoomID string `json:"roomID"`
+	Epoch  uint64 `json:"epoch"`
+	ID     string `json:"id"`
+	Sealed string `json:"sealed"`
+}
+
+// RoomMessage is the content of an envelope. Clock counts the messages of
+// every member the sender had delivered when it sent this one, including
+// this one, so that receivers deliver them in causal order.
+type RoomMessage struct {
+	Sender string            `json:"sender"`
+	Clock  map[string]uint64 `json:"clock"`
+	Chat   Chat              `json:"chat"`
+}
+
+// earlyKey is a group key that arrived before the member list of its epoch
+type earlyKey struct {
+	from string
+	key  *RoomKey
+}
+
+// Room is a group conversation. Its messages fan out over the peer sessions
+// with the other members and are sealed with a group key that changes with
+// every epoch.
+type Room struct {
+	id        string
+	self      string
+	epoch     uint64
+	members   []*Peer
+	key       *[32]byte
+	early     map[uint64]earlyKey
+	delivered map[string]uint64
+	seen      map[string]bool
+	pending   []*RoomMessage
+	sealed    []*RoomEnvelope
+	m         *sync.Mutex
+}
+
+func (r *Room) GetID() string {
+	return r.id
+}
+
+func (r *Room) GetEpoch() uint64 {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.epoch
+}
+
+func (r *Room) GetMembers() []*Peer {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return append([]*Peer(nil), r.members...)
+}
+
+// Member returns the member with the ID
+func (r *Room) Member(id string) (*Peer, bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.member(id)
+}
+
+func (r *Room) member(id string) (*Peer, bool) {
+	for _, p := range r.members {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// Keeper returns the ID of the member that picks the group keys
+func (r *Room) Keeper() string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.keeper()
+}
+
+func (r *Room) keeper() string {
+	if len(r.members) == 0 {
+		return ""
+	}
+	return r.members[0].ID
+}
+
+// Update moves the room to the membership of a newer epoch, which starts
+// without a group key and with fresh clocks. It returns false when info is
+// not newer than what the room has, and the messages a key that arrived
+// early let it deliver.
+func (r *Room) Update(info *RoomInfo) (bool, []*RoomMessage) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if info.Epoch <= r.epoch {
+		return false, nil
+	}
+
+	members := append([]*Peer(nil), info.Members...)
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ID < members[j].ID
+	})
+
+	r.epoch = info.Epoch
+	r.members = members
+	r.key = nil
+	r.delivered = make(map[string]uint64)
+	r.seen = make(map[string]bool)
+	r.pending = nil
+
+	for epoch := range r.early {
+		if epoch < r.epoch {
+			delete(r.early, epoch)
+		}
+	}
+	k, ok := r.early[r.epoch]
+	if !ok || k.from != r.keeper() {
+		return true, nil
+	}
+	delete(r.early, r.epoch)
+	out, _ := r.setKey(k.key)
+	return true, out
+}
+
+// NewKey picks the group key of the current epoch, only the keeper does
+func (r *Room) NewKey() (*RoomKey, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.keeper() != r.self {
+		return nil, errors.New("only the keeper of a room picks its keys")
+	}
+
+	var key [32]byte
+	_, err := crand.Read(key[:])
+	if err != nil {
+		return nil, err
+	}
+	r.key = &key
+	return r.roomKey(), nil
+}
+
+// Key returns the group key of the current epoch for sending to a member
+func (r *Room) Key() (*RoomKey, bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.key == nil {
+		return nil, false
+	}
+	return r.roomKey(), true
+}
+
+func (r *Room) roomKey() *RoomKey {
+	return &RoomKey{
+		RoomID: r.id,
+		Epoch:  r.epoch,
+		Key:    base64.StdEncoding.EncodeToString(r.key[:]),
+	}
+}
+
+// SetKey installs a group key sent by the member with the ID from. It
+// returns the messages that were waiting for it.
+func (r *Room) SetKey(from string, k *RoomKey) ([]*RoomMessage, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	switch {
+	case k.Epoch < r.epoch:
+		return nil, fmt.Errorf("key of room %s is for the old epoch %d", r.id, k.Epoch)
+	case k.Epoch > r.epoch:
+		// the member list of the epoch is still on its way, the keeper is
+		// checked once it arrives
+		if len(r.early) < MaxRoomPending {
+			r.early[k.Epoch] = earlyKey{from: from, key: k}
+		}
+		return nil, nil
+	}
+
+	if from != r.keeper() {
+		return nil, fmt.Errorf("%s does not keep room %s", from, r.id)
+	}
+	return r.setKey(k)
+}
+
+// setKey installs the key of the current epoch and opens the envelopes that
+// were waiting for it, r.m must be held
+func (r *Room) setKey(k *RoomKey) ([]*RoomMessage, error) {
+	key, err := decodeKey(k.Key)
+	if err != nil {
+		return nil, err
+	}
+	r.key = &key
+
+	sealed := r.sealed
+	r.sealed = nil
+	var out []*RoomMessage
+	for _, env := range sealed {
+		if env.Epoch != r.epoch {
+			if env.Epoch > r.epoch {
+				r.sealed = append(r.sealed, env)
+			}
+			continue
+		}
+		msg, err := r.open(env)
+		if err != nil {
+			continue
+		}
+		out = append(out, r.deliver(msg)...)
+	}
+	return out, nil
+}
+
+// Seal builds the envelope of a line of text from the client
+func (r *Room) Seal(text string) (*RoomEnvelope, *Chat, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.key == nil {
+		return nil, nil, errors.New("the key of the room has not arrived yet")
+	}
+
+	r.delivered[r.self] += 1
+	clock := make(map[string]uint64, len(r.delivered))
+	for id, n := range r.delivered {
+		clock[id] = n
+	}
+	msg := &RoomMessage{
+		Sender: r.self,
+		Clock:  clock,
+		Chat:   Chat{ID: GenMessageID(), Text: text},
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	ct, err := crypto.Encrypt(b, *r.key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	env := &RoomEnvelope{
+		RoomID: r.id,
+		Epoch:  r.epoch,
+		ID:     fmt.Sprintf("%s/%d", r.self, clock[r.self]),
+		Sealed: base64.StdEncoding.EncodeToString(ct),
+	}
+	r.seen[env.ID] = true
+	return env, &msg.Chat, nil
+}
+
+// Receive takes an envelope from a member. It returns false when the
+// envelope has been seen before or belongs to an old epoch, so it should not
+// be relayed, and the messages that can be delivered now.
+func (r *Room) Receive(env *RoomEnvelope) (bool, []*RoomMessage, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if env.Epoch < r.epoch {
+		return false, nil, nil
+	}
+	if env.Epoch == r.epoch {
+		if r.seen[env.ID] {
+			return false, nil, nil
+		}
+		r.seen[env.ID] = true
+	}
+
+	// keep the envelope until the key or the member list of its epoch
+	// arrives
+	if env.Epoch > r.epoch || r.key == nil {
+		for _, e := range r.sealed {
+			if e.Epoch == env.Epoch && e.ID == env.ID {
+				return false, nil, nil
+			}
+		}
+		if len(r.sealed) >= MaxRoomPending {
+			return true, nil, errors.New("too many room messages are waiting for a key")
+		}
+		r.sealed = append(r.sealed, env)
+		return true, nil, nil
+	}
+
+	msg, err := r.open(env)
+	if err != nil {
+		return true, nil, err
+	}
+	return true, r.deliver(msg), nil
+}
+
+// open decrypts an envelope of the current epoch, r.m must be held
+func (r *Room) open(env *RoomEnvelope) (*RoomMessage, error) {
+	ct, err := base64.StdEncoding.DecodeString(env.Sealed)
+	if err != nil {
+		return nil, err
+	}
+	b, err := crypto.Decrypt(ct, *r.key)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &RoomMessage{}
+	err = json.Unmarshal(b, msg)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := r.member(msg.Sender); !ok {
+		return nil, fmt.Errorf("%s is not a member of room %s", msg.Sender, r.id)
+	}
+	if env.ID != fmt.Sprintf("%s/%d", msg.Sender, msg.Clock[msg.Sender]) {
+		return nil, errors.New("room envelope does not match its message")
+	}
+	return msg, nil
+}
+
+// deliver holds msg back until every message it depends on has been
+// delivered and returns the messages that are ready, r.m must be held
+func (r *Room) deliver(msg *RoomMessage) []*RoomMessage {
+	if msg.Clock[msg.Sender] <= r.delivered[msg.Sender] {
+		return nil
+	}
+	if len(r.pending) >= MaxRoomPending {
+		return nil
+	}
+	r.pending = append(r.pending, msg)
+
+	var out []*RoomMessage
+	for progress := true; progress; {
+		progress = false
+		for i, m := range r.pending {
+			if !r.ready(m) {
+				continue
+			}
+			r.delivered[m.Sender] = m.Clock[m.Sender]
+			r.pending = append(r.pending[:i], r.pending[i+1:]...)
+			out = append(out, m)
+			progress = true
+			break
+		}
+	}
+	return out
+}
+
+// ready reports whether m is the next message of its sender and everything
+// the sender had delivered before sending it has been delivered here
+func (r *Room) ready(m *RoomMessage) bool {
+	for id, n := range m.Clock {
+		if id == m.Sender {
+			if n != r.delivered[id]+1 {
+				return false
+			}
+		} else if n > r.delivered[id] {
+			return false
+		}
+	}
+	return true
+}
+
+func NewRoom(id, self string) *Room {
+	return &Room{
+		id:        id,
+		self:      self,
+		early:     make(map[uint64]earlyKey),
+		delivered: make(map[string]uint64),
+		seen:      make(map[string]bool),
+		m:         &sync.Mutex{},
+	}
+}
+
+// Rooms is the table of the rooms a client is a member of keyed by room ID
+type Rooms struct {
+	rooms map[string]*Room
+	m     *sync.RWMutex
+}
+
+func (rs *Rooms) Get(id string) (*Room, bool) {
+	rs.m.RLock()
+	defer rs.m.RUnlock()
+	r, ok := rs.rooms[id]
+	return r, ok
+}
+
+// GetOrAdd returns the room with the ID, adding it when there is none
+func (rs *Rooms) GetOrAdd(id, self string) *Room {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+	r, ok := rs.rooms[id]
+	if !ok {
+		r = NewRoom(id, self)
+		rs.rooms[id] = r
+	}
+	return r
+}
+
+// Remove takes the room out of the table. It returns false when it was not
+// in it.
+func (rs *Rooms) Remove(r *Room) bool {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+	if rs.rooms[r.id] != r {
+		return false
+	}
+	delete(rs.rooms, r.id)
+	return true
+}
+
+// List returns the rooms ordered by ID
+func (rs *Rooms) List() []*Room {
+	rs.m.RLock()
+	defer rs.m.RUnlock()
+	l := make([]*Room, 0, len(rs.rooms))
+	for _, r := range rs.rooms {
+		l = append(l, r)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].id < l[j].id
+	})
+	return l
+}
+
+func NewRooms() *Rooms {
+	return &Rooms{
+		rooms: make(map[string]*Room),
+		m:     &sync.RWMutex{},
+	}
+}
+
+// FanOut sends an envelope to every member of the room there is an
+// established session with, except the member with the ID except
+func (r *Room) FanOut(sessions *Sessions, env *RoomEnvelope, except string) error {
+	var err error
+	for _, p := range r.GetMembers() {
+		if p.ID == r.self || p.ID == except {
+			continue
+		}
+		s, ok := sessions.Get(p.ID)
+		if !ok || !s.Established() {
+			continue
+		}
+		e := s.GetConn().Send(&Message{
+			Type:     "room-message",
+			PeerID:   r.self,
+			Content:  env,
+			Encrypt:  true,
+			Reliable: true,
+		})
+		if e != nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package shared
+
+import (
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+const (
+	// PathTimeout is how long to wait for the answer to a path challenge
+	PathTimeout = time.Second
+	// PathRetries is how many challenges are sent to a new address before
+	// the session falls back to the address it had before
+	PathRetries = 3
+)
+
+// encrypted messages start with a byte that can not begin a JSON message
+// followed by the ID of the session that sealed them
+const sealedMarker byte = 0x01
+
+const sealedHeaderSize = 1 + len(SessionID{})
+
+// SessionID identifies the keys a message was sealed with. It travels in the
+// clear so that a packet arriving from an unknown address can be matched to
+// its session, the keys then prove that the packet belongs to it.
+type SessionID [8]byte
+
+func (id SessionID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// NewSessionID derives the ID both ends of a session compute from its root
+// key
+func NewSessionID(root [32]byte) SessionID {
+	var id SessionID
+	k := deriveKey(root[:], "session id")
+	copy(id[:], k[:])
+	return id
+}
+
+// PacketSession returns the session an encrypted message claims to belong to
+func PacketSession(b []byte) (SessionID, bool) {
+	var id SessionID
+	if len(b) < sealedHeaderSize || b[0] != sealedMarker {
+		return id, false
+	}
+	copy(id[:], b[1:sealedHeaderSize])
+	return id, true
+}
+
+func seal(cipher Cipher, b []byte) ([]byte, error) {
+	ct, err := cipher.Seal(b)
+	if err != nil {
+		return nil, err
+	}
+
+	id := cipher.Session()
+	out := make([]byte, sealedHeaderSize, sealedHeaderSize+len(ct))
+	out[0] = sealedMarker
+	copy(out[1:], id[:])
+	return append(out, ct...), nil
+}
+
+func open(cipher Cipher, b []byte) ([]byte, error) {
+	id, ok := PacketSession(b)
+	if !ok {
+		return nil, errors.New("message is not encrypted")
+	}
+	if id != cipher.Session() {
+		return nil, errors.New("message belongs to another session")
+	}
+	return cipher.Open(b[sealedHeaderSize:])
+}
+
+// PathChallenge is sent to a new address of a session, the session moves to
+// the address for good once the token is echoed back from it
+type PathChallenge struct {
+	Token string `json:"token"`
+}
@@ -0,0 +1,183 @@
+package shared
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Session is the conversation with one peer: who the peer is, the Conn its
+// handshake runs on and the safety number the handshake produced
+type Session struct {
+	peer    *Peer
+	conn    Conn
+	sas     string
+	dialed  bool
+	punchAt time.Time
+	ready   chan struct{}
+	m       *sync.RWMutex
+}
+
+func (s *Session) GetPeer() *Peer {
+	return s.peer
+}
+
+func (s *Session) GetConn() Conn {
+	return s.conn
+}
+
+func (s *Session) GetSAS() string {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.sas
+}
+
+func (s *Session) SetSAS(sas string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.sas = sas
+}
+
+// PunchAt returns when the server asked both peers to start punching, the
+// zero time when it did not
+func (s *Session) PunchAt() time.Time {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.punchAt
+}
+
+func (s *Session) SetPunchAt(t time.Time) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.punchAt = t
+}
+
+// Ready is closed once the handshake has installed the session keys
+func (s *Session) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// SetReady records that the handshake has installed the session keys
+func (s *Session) SetReady() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	select {
+	case <-s.ready:
+	default:
+		close(s.ready)
+	}
+}
+
+// Dialed reports whether the client asked for the session rather than the
+// peer
+func (s *Session) Dialed() bool {
+	return s.dialed
+}
+
+// Established reports whether the handshake has installed the session keys
+func (s *Session) Established() bool {
+	_, err := s.conn.GetCipher()
+	return err == nil
+}
+
+func NewSession(peer *Peer, conn Conn, dialed bool) *Session {
+	return &Session{
+		peer:   peer,
+		conn:   conn,
+		dialed: dialed,
+		ready:  make(chan struct{}),
+		m:      &sync.RWMutex{},
+	}
+}
+
+// Sessions is the table of a client's peer sessions keyed by peer ID. It
+// also remembers the peers of sessions that have ended.
+type Sessions struct {
+	sessions map[string]*Session
+	known    map[string]*Peer
+	m        *sync.RWMutex
+}
+
+func (ss *Sessions) Get(peerID string) (*Session, bool) {
+	ss.m.RLock()
+	defer ss.m.RUnlock()
+	s, ok := ss.sessions[peerID]
+	return s, ok
+}
+
+// ByConn returns the session that runs on conn
+func (ss *Sessions) ByConn(conn Conn) (*Session, bool) {
+	ss.m.RLock()
+	defer ss.m.RUnlock()
+	for _, s := range ss.sessions {
+		if s.conn == conn {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// Add adds s unless there already is a session with its peer
+func (ss *Sessions) Add(s *Session) bool {
+	ss.m.Lock()
+	defer ss.m.Unlock()
+	if _, ok := ss.sessions[s.peer.ID]; ok {
+		return false
+	}
+	ss.sessions[s.peer.ID] = s
+	ss.known[s.peer.ID] = s.peer
+	return true
+}
+
+// Known returns the peer of the last session with the peer ID, whether or
+// not the session is still running
+func (ss *Sessions) Known(peerID string) (*Peer, bool) {
+	ss.m.RLock()
+	defer ss.m.RUnlock()
+	p, ok := ss.known[peerID]
+	return p, ok
+}
+
+// Remove takes s out of the table. It returns false when s was not in it, so
+// that only one caller reports the end of a session.
+func (ss *Sessions) Remove(s *Session) bool {
+	ss.m.Lock()
+	defer ss.m.Unlock()
+	if ss.sessions[s.peer.ID] != s {
+		return false
+	}
+	delete(ss.sessions, s.peer.ID)
+	return true
+}
+
+// Active reports whether s is still in the table
+func (ss *Sessions) Active(s *Session) bool {
+	ss.m.RLock()
+	defer ss.m.RUnlock()
+	return ss.sessions[s.peer.ID] == s
+}
+
+// List returns the sessions ordered by the username of their peer
+func (ss *Sessions) List() []*Session {
+	ss.m.RLock()
+	defer ss.m.RUnlock()
+	l := make([]*Session, 0, len(ss.sessions))
+	for _, s := range ss.sessions {
+		l = append(l, s)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].peer.Username != l[j].peer.Username {
+			return l[i].peer.Username < l[j].peer.Username
+		}
+		return l[i].peer.ID < l[j].peer.ID
+	})
+	return l
+}
+
+func NewSessions() *Sessions {
+	return &Sessions{
+		sessions: make(map[string]*Session),
+		known:    make(map[string]*Peer),
+		m:        &sync.RWMutex{},
+	}
+}
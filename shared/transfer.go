@@ -0,0 +1,507 @@
+package shared
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// ChunkSize is the number of file bytes carried by a chunk message.
+	// Base64 grows it to 684 bytes which leaves room for the envelope and
+	// the encryption overhead within MaxDatagramSize.
+	ChunkSize = 512
+	// AckInterval is how many bytes the receiver writes between acks
+	AckInterval = 64 * ChunkSize
+)
+
+// FileOffer proposes sending a file to the peer
+type FileOffer struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+}
+
+// FileAccept asks the sender to start sending a file from Offset
+type FileAccept struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+}
+
+// FileChunk carries ChunkSize bytes of a file, base64 encoded
+type FileChunk struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+	Data   string `json:"data"`
+}
+
+// FileAck tells the sender how much of a file has been written to disk
+type FileAck struct {
+	ID       string `json:"id"`
+	Offset   int64  `json:"offset"`
+	Complete bool   `json:"complete,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Transfer is the progress of a file being sent or received
+type Transfer struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Offset   int64  `json:"offset"`
+	PeerID   string `json:"peerID"`
+	Sending  bool   `json:"sending"`
+	Accepted bool   `json:"accepted"`
+	Complete bool   `json:"complete"`
+	Error    string `json:"error,omitempty"`
+	path     string
+	part     string
+	hash     string
+	f        *os.File
+	acked    int64
+	// incremented whenever the sender restarts so that an old send loop
+	// notices it has been replaced
+	run int
+}
+
+// Path is where the file is read from or, once complete, written to
+func (t *Transfer) Path() string {
+	return t.path
+}
+
+func (t *Transfer) fail(err error) {
+	t.Error = err.Error()
+	if t.f != nil {
+		t.f.Close()
+		t.f = nil
+	}
+}
+
+// transferKey identifies a transfer by the peer it is exchanged with and its
+// ID, peers pick the IDs of the files they offer
+type transferKey struct {
+	peerID string
+	id     string
+}
+
+// Transfers tracks the files being sent to and received from peers.
+// Received files are written to dir.
+type Transfers struct {
+	dir      string
+	selfID   string
+	sent     map[transferKey]*Transfer
+	received map[transferKey]*Transfer
+	m        *sync.Mutex
+}
+
+// Received returns a copy of the transfer of the file the peer offered with
+// the ID
+func (ts *Transfers) Received(peerID, id string) (*Transfer, bool) {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+	t, ok := ts.received[transferKey{peerID, id}]
+	if !ok {
+		return nil, false
+	}
+	cp := *t
+	return &cp, true
+}
+
+// Path returns where a completed transfer received from the peer is stored
+func (ts *Transfers) Path(peerID, id string) (string, error) {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+	t, ok := ts.received[transferKey{peerID, id}]
+	if !ok || !t.Complete {
+		return "", errors.New("transfer has not completed")
+	}
+	return t.path, nil
+}
+
+// Offer prepares the file at path to be sent to the peer. Offering a file
+// again resumes the earlier transfer of it.
+func (ts *Transfers) Offer(path, peerID string) (*Transfer, *FileOffer, error) {
+	hash, size, err := hashFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the same content with the same name sent to the same peer gets the same
+	// ID so that the receiver can find what it already has
+	name := filepath.Base(path)
+	sum := sha256.Sum256([]byte(hash + "/" + name + "/" + ts.selfID + "/" + peerID))
+	id := hex.EncodeToString(sum[:8])
+
+	ts.m.Lock()
+	defer ts.m.Unlock()
+	t, ok := ts.sent[transferKey{peerID, id}]
+	if !ok || t.Complete {
+		t = &Transfer{
+			ID:      id,
+			Name:    name,
+			Size:    size,
+			PeerID:  peerID,
+			Sending: true,
+			path:    path,
+			hash:    hash,
+		}
+		ts.sent[transferKey{peerID, id}] = t
+	}
+	t.Error = ""
+
+	cp := *t
+	return &cp, &FileOffer{ID: id, Name: name, Size: size, Hash: hash}, nil
+}
+
+// Pending returns the unfinished transfers being sent to the peer
+func (ts *Transfers) Pending(peerID string) []*Transfer {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+	var pending []*Transfer
+	for _, t := range ts.sent {
+		if !t.Complete && t.PeerID == peerID {
+			cp := *t
+			pending = append(pending, &cp)
+		}
+	}
+	return pending
+}
+
+// Receive records a file offered by the peer. It reports whether the offer
+// resumes a file that was already accepted, such a file should be accepted
+// again without asking the user.
+func (ts *Transfers) Receive(o *FileOffer, peerID string) (*Transfer, bool, error) {
+	name := filepath.Base(o.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) || o.Size < 0 {
+		return nil, false, fmt.Errorf("invalid file offer %s", o.Name)
+	}
+	if _, err := hex.DecodeString(o.Hash); err != nil || len(o.Hash) != 2*sha256.Size {
+		return nil, false, errors.New("file offer has an invalid hash")
+	}
+	// only accept IDs that look like the ones Offer creates
+	if _, err := hex.DecodeString(o.ID); err != nil || len(o.ID) != 16 {
+		return nil, false, errors.New("file offer has an invalid ID")
+	}
+
+	ts.m.Lock()
+	defer ts.m.Unlock()
+	key := transferKey{peerID, o.ID}
+	t, ok := ts.received[key]
+	if !ok || t.hash != o.Hash {
+		if ok && t.f != nil {
+			t.f.Close()
+		}
+		// peers may offer files with the same ID so the partial file is
+		// named after both
+		sum := sha256.Sum256([]byte(peerID + "/" + o.ID))
+		path := filepath.Join(ts.dir, name)
+		t = &Transfer{
+			ID:     o.ID,
+			Name:   name,
+			Size:   o.Size,
+			PeerID: peerID,
+			path:   path,
+			part:   path + "." + hex.EncodeToString(sum[:8]) + ".part",
+			hash:   o.Hash,
+		}
+		ts.received[key] = t
+	}
+
+	cp := *t
+	return &cp, t.Accepted && !t.Complete, nil
+}
+
+// Accept opens the partial file of a received transfer and returns the
+// offset the sender should continue from. A file that needs no more chunks,
+// such as an empty one, is finished right away and its final ack returned.
+func (ts *Transfers) Accept(peerID, id string) (*FileAccept, *FileAck, error) {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+	t, ok := ts.received[transferKey{peerID, id}]
+	if !ok {
+		return nil, nil, fmt.Errorf("no file offered with ID %s", id)
+	}
+	if t.Complete {
+		return nil, nil, errors.New("file has already been received")
+	}
+
+	err := os.MkdirAll(ts.dir, 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t.f != nil {
+		t.f.Close()
+	}
+	t.f, err = os.OpenFile(t.part, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// continue after what was acknowledged, anything written after the
+	// last ack may not have reached the disk
+	fi, err := t.f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	offset := t.acked
+	if !t.Accepted || fi.Size() < offset {
+		offset = fi.Size()
+	}
+	if offset > t.Size {
+		offset = 0
+	}
+	err = t.f.Truncate(offset)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = t.f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t.Accepted = true
+	t.Error = ""
+	t.Offset = offset
+	t.acked = offset
+
+	a := &FileAccept{ID: id, Offset: offset}
+	if offset == t.Size {
+		return a, ts.finish(t), nil
+	}
+	return a, nil, nil
+}
+
+// Start marks an offered file as accepted by the peer and returns the run
+// the send loop must belong to
+func (ts *Transfers) Start(peerID string, a *FileAccept) (*Transfer, int, error) {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+	t, ok := ts.sent[transferKey{peerID, a.ID}]
+	if !ok {
+		return nil, 0, fmt.Errorf("peer accepted unknown file %s", a.ID)
+	}
+	if a.Offset < 0 || a.Offset > t.Size {
+		return nil, 0, fmt.Errorf("peer accepted file %s at invalid offset %d", a.ID, a.Offset)
+	}
+
+	t.Accepted = true
+	t.Offset = a.Offset
+	t.acked = a.Offset
+	t.run += 1
+	cp := *t
+	return &cp, t.run, nil
+}
+
+// Send reads the file of an accepted transfer from offset and passes each
+// chunk to send. It stops when the transfer is restarted or fails.
+func (ts *Transfers) Send(peerID, id string, run int, offset int64, send func(*FileChunk) error) error {
+	ts.m.Lock()
+	t, ok := ts.sent[transferKey{peerID, id}]
+	if !ok {
+		ts.m.Unlock()
+		return fmt.Errorf("unknown transfer %s", id)
+	}
+	path := t.path
+	ts.m.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	b := make([]byte, ChunkSize)
+	for {
+		ts.m.Lock()
+		stale := t.run != run || t.Error != ""
+		ts.m.Unlock()
+		if stale {
+			return nil
+		}
+
+		n, err := f.Read(b)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = send(&FileChunk{
+			ID:     id,
+			Offset: offset,
+			Data:   base64.StdEncoding.EncodeToString(b[:n]),
+		})
+		if err != nil {
+			return err
+		}
+		offset += int64(n)
+	}
+}
+
+// Write stores a chunk received from the peer. It returns an ack when one is due, once
+// the last chunk has been written the file is verified and moved into place.
+// A transfer that fails is reported in the ack, chunks that arrive after it
+// failed are dropped.
+func (ts *Transfers) Write(peerID string, c *FileChunk) (*Transfer, *FileAck, error) {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+	t, ok := ts.received[transferKey{peerID, c.ID}]
+	if !ok || !t.Accepted {
+		return nil, nil, fmt.Errorf("received chunk of unknown file %s", c.ID)
+	}
+	// chunks sent before a resume or a failure can still arrive
+	if t.f == nil || c.Offset < t.Offset {
+		return nil, nil, nil
+	}
+
+	var err error
+	var b []byte
+	if c.Offset > t.Offset {
+		err = errors.New("chunks arrived out of order")
+	} else {
+		b, err = base64.StdEncoding.DecodeString(c.Data)
+		if err != nil || len(b) > ChunkSize || t.Offset+int64(len(b)) > t.Size {
+			err = errors.New("received an invalid chunk")
+		}
+	}
+	if err == nil {
+		_, err = t.f.Write(b)
+	}
+	if err != nil {
+		return ts.failed(t, err)
+	}
+	t.Offset += int64(len(b))
+
+	if t.Offset == t.Size {
+		a := ts.finish(t)
+		cp := *t
+		return &cp, a, nil
+	}
+	if t.Offset-t.acked < AckInterval {
+		return nil, nil, nil
+	}
+
+	err = t.f.Sync()
+	if err != nil {
+		return ts.failed(t, err)
+	}
+	t.acked = t.Offset
+	cp := *t
+	return &cp, &FileAck{ID: t.ID, Offset: t.Offset}, nil
+}
+
+func (ts *Transfers) failed(t *Transfer, err error) (*Transfer, *FileAck, error) {
+	t.fail(err)
+	cp := *t
+	return &cp, &FileAck{ID: t.ID, Offset: t.acked, Error: t.Error}, nil
+}
+
+// finish verifies a fully received file and moves it into place
+func (ts *Transfers) finish(t *Transfer) *FileAck {
+	t.f.Close()
+	t.f = nil
+
+	hash, _, err := hashFile(t.part)
+	if err == nil && hash != t.hash {
+		// start over if the transfer is resumed
+		os.Remove(t.part)
+		t.Accepted = false
+		t.acked = 0
+		err = errors.New("file does not match the offered SHA-256 hash")
+	}
+	var path string
+	if err == nil {
+		// never replace a file that is already there
+		path, err = freePath(t.path)
+	}
+	if err == nil {
+		err = os.Rename(t.part, path)
+	}
+	if err != nil {
+		t.Error = err.Error()
+		return &FileAck{ID: t.ID, Offset: t.Offset, Error: t.Error}
+	}
+
+	t.path = path
+	t.Complete = true
+	t.acked = t.Offset
+	return &FileAck{ID: t.ID, Offset: t.Offset, Complete: true}
+}
+
+// Acked records an ack from the peer receiving a file
+func (ts *Transfers) Acked(peerID string, a *FileAck) (*Transfer, error) {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+	t, ok := ts.sent[transferKey{peerID, a.ID}]
+	if !ok {
+		return nil, fmt.Errorf("ack for unknown file %s", a.ID)
+	}
+
+	if a.Offset > t.acked && a.Offset <= t.Size {
+		t.acked = a.Offset
+		t.Offset = a.Offset
+	}
+	t.Complete = a.Complete
+	t.Error = a.Error
+	cp := *t
+	return &cp, nil
+}
+
+// freePath returns path or, when a file is already there, the first of
+// "name (1).ext", "name (2).ext"... that is not taken
+func freePath(path string) (string, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	p := path
+	for i := 1; i <= 1000; i++ {
+		_, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		p = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	return "", fmt.Errorf("too many files named %s", filepath.Base(path))
+}
+
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// NewTransfers tracks the transfers of the client with selfID
+func NewTransfers(dir, selfID string) *Transfers {
+	return &Transfers{
+		dir:      dir,
+		selfID:   selfID,
+		sent:     make(map[transferKey]*Transfer),
+		received: make(map[transferKey]*Transfer),
+		m:        &sync.Mutex{},
+	}
+}
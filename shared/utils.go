@@ -1,11 +1,16 @@
 package shared
 
 import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/wilfreddenton/crypto"
@@ -21,17 +26,23 @@ func MessageIn(c Conn, b []byte) (*Message, error) {
 
 	// if there is an error, check if message is encrypted, if so, decrypt and unmarshal
 	if err != nil {
-		var secret [32]byte
-		secret, err = c.GetSecret()
+		var cipher Cipher
+		cipher, err = c.GetCipher()
 		if err == nil {
 			// decrypt
-			b, err = crypto.Decrypt(b, secret)
+			b, err = open(cipher, b)
 			if err != nil {
 				return m, err
 			}
 
 			// unmarshal into Request struct
 			err = json.Unmarshal(b, m)
+			m.encrypted = true
+
+			// the peer has the transport keys so the handshake is over
+			if h := c.GetHandshake(); h != nil {
+				h.Confirm()
+			}
 		}
 
 		// if there was an error unmarshalling initially and either the message wasn't encrypted or unmarshaling the unencrypted message failed
@@ -51,13 +62,13 @@ func MessageOut(c Conn, m *Message) ([]byte, error) {
 	}
 
 	if m.Encrypt {
-		var s [32]byte
-		s, err = c.GetSecret()
+		var cipher Cipher
+		cipher, err = c.GetCipher()
 		if err != nil {
 			return b, fmt.Errorf("cannot encrypt with an empty secret")
 		}
 		// encrypt message content
-		b, err = crypto.Encrypt(b, s)
+		b, err = seal(cipher, b)
 		if err != nil {
 			return b, err
 		}
@@ -66,31 +77,78 @@ func MessageOut(c Conn, m *Message) ([]byte, error) {
 	return b, nil
 }
 
-func route(client Client, cs Conns, c Conn, m *Message) (*Message, error) {
+func route(client Client, c Conn, m *Message) (*Message, error) {
+	// a payload that could not be read is answered without a type, there is
+	// no request to report the error for
+	if m.Type == "" && m.Error != "" {
+		client.GetLog().Printf("%s could not read a message: %s", c.GetAddr(), m.Error)
+		return nil, nil
+	}
+	// peers answer a message they could not handle with an error under its
+	// type, it is not handled as a request
+	if m.Error != "" && c != client.GetServerConn() {
+		return peerErrorHandler(client, c, m)
+	}
+
 	switch m.Type {
-	case "greeting":
-		return greetingHandler(client, c, m)
+	case "handshake":
+		return handshakeHandler(client, c, m)
 	case "register":
 		return registerHandler(client, c, m)
 	case "establish":
 		return establishHandler(client, c, m)
 	case "connect":
 		return connectHandler(client, c, m)
-	case "key":
-		return keyHandler(client, c, m)
+	case "rekey":
+		return rekeyHandler(client, c, m)
+	case "ping":
+		return pingHandler(client, c, m)
+	case "pong":
+		return nil, nil
+	case "clock":
+		return clockHandler(client, c, m)
+	case "disconnect":
+		return disconnectHandler(client, c, m)
 	case "message":
 		return messageHandler(client, c, m)
+	case "receipt":
+		return receiptHandler(client, c, m)
+	case "signal":
+		return signalHandler(client, c, m)
+	case "offer":
+		return offerHandler(client, c, m)
+	case "accept":
+		return acceptHandler(client, c, m)
+	case "chunk":
+		return chunkHandler(client, c, m)
+	case "file-ack":
+		return fileAckHandler(client, c, m)
+	case "stream":
+		return streamHandler(client, c, m)
+	case "datagram":
+		return datagramHandler(client, c, m)
+	case "room":
+		return roomHandler(client, c, m)
+	case "create-room", "join-room", "leave-room", "mail-ack":
+		return requestErrorHandler(client, c, m)
+	case "room-key":
+		return roomKeyHandler(client, c, m)
+	case "room-message":
+		return roomMessageHandler(client, c, m)
+	case "mail":
+		return mailHandler(client, c, m)
+	case "mailbox":
+		return mailboxHandler(client, c, m)
 	}
-	return nil, nil
+	return nil, NewProtocolError(UnsupportedType, "message type %s is not supported", m.Type)
 }
 
-func CreateMessageCallback(client Client) func(Conns, Conn, *Message) {
-	return func(cs Conns, c Conn, m *Message) {
-		// ensure there was no error during registration
-		res, err := route(client, cs, c, m)
+func CreateMessageCallback(client Client) func(Conn, *Message) {
+	return func(c Conn, m *Message) {
+		res, err := route(client, c, m)
 		if err != nil {
-			fmt.Println(err)
-			client.GetLog().Fatal(err)
+			handleError(client, c, m, err)
+			return
 		}
 
 		if res != nil {
@@ -99,6 +157,38 @@ func CreateMessageCallback(client Client) func(Conns, Conn, *Message) {
 	}
 }
 
+// GenID derives a client ID from its public key: SHA-2 + HMAC hash of the key
+func GenID(pubKey [32]byte) string {
+	return hex.EncodeToString(crypto.Hash("hashing client public key for client id", pubKey[:]))
+}
+
+// GenSAS derives a short authentication string from both peers' public keys
+// and the session transcript. Both peers compute the same string so reading
+// it to each other out of band proves that no one sits between them.
+func GenSAS(a, b [32]byte, transcript []byte) string {
+	// order the keys so that both peers hash the same bytes
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+	data := append(append(a[:], b[:]...), transcript...)
+	h := crypto.Hash("short authentication string", data)
+
+	// 5 groups of 4 digits taken from the hash
+	groups := make([]string, 5)
+	for i := range groups {
+		n := binary.BigEndian.Uint32(h[i*4 : i*4+4])
+		groups[i] = fmt.Sprintf("%04d", n%10000)
+	}
+	return strings.Join(groups, " ")
+}
+
+// GenMessageID returns a random ID for a chat message
+func GenMessageID() string {
+	b := make([]byte, 8)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 func GenPort() string {
 	return ":" + strconv.Itoa(rand.Intn(65535-10000)+10000)
 }
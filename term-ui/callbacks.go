@@ -1,9 +1,14 @@
 package main
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/wilfreddenton/udp-hole-punching/shared"
 )
@@ -11,7 +16,9 @@ import (
 func registeredCallback(c shared.Client) {
 	fmt.Println("  (1) Connect with a Peer")
 	fmt.Println("  (2) Wait for a peer to connect")
-	fmt.Println("  (3) Exit")
+	fmt.Println("  (3) Create a room")
+	fmt.Println("  (4) Join a room")
+	fmt.Println("  (5) Exit")
 	var n int
 	for {
 		fmt.Print("  > ")
@@ -27,16 +34,37 @@ func registeredCallback(c shared.Client) {
 				fmt.Scanln(&id)
 			}
 			fmt.Print("\n")
-			c.GetServerConn().Send(&shared.Message{
-				Type:    "establish",
-				PeerID:  c.GetSelf().ID,
-				Content: id,
-			})
+			err := c.Establish(id)
+			if err != nil {
+				fmt.Printf("  %s\n\n", err)
+				continue
+			}
 			return
 		case 2:
 			fmt.Print("  waiting...\n\n")
 			return
 		case 3:
+			err := c.CreateRoom()
+			if err != nil {
+				fmt.Printf("  %s\n\n", err)
+				continue
+			}
+			return
+		case 4:
+			fmt.Println("  RoomID")
+			fmt.Print("  > ")
+			var id string
+			for id == "" {
+				fmt.Scanln(&id)
+			}
+			fmt.Print("\n")
+			err := c.JoinRoom(id)
+			if err != nil {
+				fmt.Printf("  %s\n\n", err)
+				continue
+			}
+			return
+		case 5:
 			fmt.Print("~ bye ~\n")
 			os.Exit(0)
 		default:
@@ -45,13 +73,230 @@ func registeredCallback(c shared.Client) {
 	}
 }
 
-func connectingCallback(c shared.Client) {
-	peer := c.GetPeer()
-	pConn := c.GetPeerConn()
-	fmt.Println("  connecting to peer...")
-	fmt.Printf("    Username: %s\n", peer.Username)
-	fmt.Printf("    ID: %s\n", peer.ID)
-	fmt.Printf("    Address: %s\n\n", pConn.GetAddr())
+func createConnectingCallback(p *prompt) func(c shared.Client, s *shared.Session) {
+	return func(c shared.Client, s *shared.Session) {
+		peer := s.GetPeer()
+		p.printf("  connecting to peer...\n")
+		p.printf("    Username: %s\n", peer.Username)
+		p.printf("    ID: %s\n", peer.ID)
+		p.printf("    Address: %s\n", s.GetConn().GetAddr())
+		if c.GetVerifiedPeers().IsVerified(peer.ID) {
+			p.printf("    Verified: yes\n\n")
+		} else {
+			p.printf("    Verified: no\n\n")
+		}
+	}
+}
+
+// verify prints the short authentication string of the session or, with the
+// confirm argument, records the peer as verified
+func verify(w io.Writer, c shared.Client, s *shared.Session, args string) {
+	if s == nil {
+		fmt.Fprintln(w, "  there is no active conversation")
+		return
+	}
+	peer := s.GetPeer()
+	sas := s.GetSAS()
+	if sas == "" {
+		fmt.Fprintln(w, "  the session has not been secured yet")
+		return
+	}
+
+	switch args {
+	case "":
+		fmt.Fprintf(w, "  Safety number with %s: %s\n", peer.Username, sas)
+		if c.GetVerifiedPeers().IsVerified(peer.ID) {
+			fmt.Fprintln(w, "  This peer is verified")
+		} else {
+			fmt.Fprintln(w, "  Compare it with your peer then run /verify confirm")
+		}
+	case "confirm":
+		err := c.GetVerifiedPeers().Add(peer)
+		if err != nil {
+			fmt.Fprintf(w, "  could not save verification: %s\n", err)
+			return
+		}
+		fmt.Fprintf(w, "  %s is now verified\n", peer.Username)
+	default:
+		fmt.Fprintln(w, "  usage: /verify [confirm]")
+	}
+}
+
+// sendFile offers the file at path to the peer of the session
+func sendFile(p *prompt, c shared.Client, s *shared.Session, path string) {
+	if s == nil {
+		p.printf("  there is no active conversation\n")
+		return
+	}
+	t, err := c.SendFile(s.GetPeer().ID, path)
+	if err != nil {
+		p.printf("  could not send %s: %s\n", path, err)
+		return
+	}
+	p.printf("  offered %s (%d bytes), waiting for %s to accept\n", t.Name, t.Size, s.GetPeer().Username)
+}
+
+// acceptFile downloads the file a peer offered, args are the username or ID
+// of the peer and the ID of the file
+func acceptFile(p *prompt, c shared.Client, args string) {
+	fields := strings.Fields(args)
+	if len(fields) != 2 {
+		p.printf("  type /accept <peer> <file ID>\n")
+		return
+	}
+	var peerID string
+	for _, s := range c.GetSessions().List() {
+		if s.GetPeer().Username == fields[0] || s.GetPeer().ID == fields[0] {
+			peerID = s.GetPeer().ID
+			break
+		}
+	}
+	if peerID == "" {
+		p.printf("  no conversation %q, type /peers to list them\n", fields[0])
+		return
+	}
+
+	id := fields[1]
+	err := c.AcceptFile(peerID, id)
+	if err != nil {
+		p.printf("  could not accept %s: %s\n", id, err)
+		return
+	}
+	if t, ok := c.GetTransfers().Received(peerID, id); ok && t.Complete {
+		p.printf("  received %s\n", t.Path())
+	}
+}
+
+// connectPeer asks the rendezvous server to introduce the peer with the ID
+func connectPeer(p *prompt, c shared.Client, id string) {
+	err := c.Establish(id)
+	if err != nil {
+		p.printf("  %s\n", err)
+	}
+}
+
+// listPeers prints the sessions numbered the way /switch expects them and
+// the rooms
+func listPeers(p *prompt, c shared.Client) {
+	sessions := c.GetSessions().List()
+	rooms := c.GetRooms().List()
+	if len(sessions) == 0 && len(rooms) == 0 {
+		p.printf("  no conversations, type /connect <PeerID> to start one\n")
+		return
+	}
+
+	active := p.getActive()
+	for i, s := range sessions {
+		mark := " "
+		if s == active {
+			mark = "*"
+		}
+		state := "connected"
+		if !s.Established() {
+			state = "connecting"
+		} else if c.GetVerifiedPeers().IsVerified(s.GetPeer().ID) {
+			state = "verified"
+		}
+		p.printf("  %s (%d) %s %s %s\n", mark, i+1, s.GetPeer().Username, s.GetPeer().ID, state)
+	}
+
+	room := p.getRoom()
+	for _, r := range rooms {
+		mark := " "
+		if r == room {
+			mark = "*"
+		}
+		var names []string
+		for _, m := range r.GetMembers() {
+			names = append(names, m.Username)
+		}
+		p.printf("  %s #%s %s\n", mark, r.GetID(), strings.Join(names, ", "))
+	}
+}
+
+// switchPeer makes the session with the number /peers printed, or with the
+// username or ID, the active one
+func switchPeer(p *prompt, c shared.Client, arg string) {
+	sessions := c.GetSessions().List()
+	if n, err := strconv.Atoi(arg); err == nil && n > 0 && n <= len(sessions) {
+		p.setActive(c, sessions[n-1])
+		p.printf("  talking to %s\n", sessions[n-1].GetPeer().Username)
+		return
+	}
+	for _, s := range sessions {
+		if s.GetPeer().Username == arg || s.GetPeer().ID == arg {
+			p.setActive(c, s)
+			p.printf("  talking to %s\n", s.GetPeer().Username)
+			return
+		}
+	}
+	if r, ok := c.GetRooms().Get(strings.TrimPrefix(arg, "#")); ok {
+		p.setRoom(c, r)
+		p.printf("  talking in #%s\n", r.GetID())
+		return
+	}
+	p.printf("  no conversation %q, type /peers to list them\n", arg)
+}
+
+// leave ends the active session or leaves the active room and switches to
+// the next conversation
+func leave(p *prompt, c shared.Client) {
+	if r := p.getRoom(); r != nil {
+		err := c.LeaveRoom(r.GetID())
+		if err != nil {
+			p.printf("  %s\n", err)
+		}
+		return
+	}
+
+	s := p.getActive()
+	if s == nil {
+		p.printf("  there is no active conversation\n")
+		return
+	}
+	err := c.Disconnect(s.GetPeer().ID, "left the conversation")
+	if err != nil {
+		p.printf("  %s\n", err)
+	}
+	p.printf("  left %s\n", s.GetPeer().Username)
+	switchNext(p, c)
+}
+
+// sendMail leaves a line for a peer that is offline on the rendezvous
+// server, args is the peer's ID followed by the text
+func sendMail(p *prompt, c shared.Client, h *shared.History, args string) {
+	id, text := args, ""
+	if i := strings.Index(args, " "); i >= 0 {
+		id, text = args[:i], strings.TrimSpace(args[i+1:])
+	}
+	if id == "" || text == "" {
+		p.printf("  type /mail <PeerID> <message>\n")
+		return
+	}
+
+	chat, err := c.SendMail(id, text)
+	if err != nil {
+		p.printf("  could not send mail: %s\n", err)
+		return
+	}
+	h.Add(fmt.Sprintf("%s > %s (mail) [%s] %s", c.GetSelf().Username, id, chat.ID, chat.Text))
+}
+
+// switchNext makes the first remaining session or room the active one
+func switchNext(p *prompt, c shared.Client) {
+	sessions := c.GetSessions().List()
+	if len(sessions) == 0 {
+		if rooms := c.GetRooms().List(); len(rooms) > 0 {
+			p.setRoom(c, rooms[0])
+			p.printf("  talking in #%s\n", rooms[0].GetID())
+			return
+		}
+		p.setActive(c, nil)
+		p.printf("  no conversations left, type /connect <PeerID> to start one\n")
+		return
+	}
+	p.setActive(c, sessions[0])
+	p.printf("  talking to %s\n", sessions[0].GetPeer().Username)
 }
 
 func spacing(s1, s2 string) string {
@@ -65,43 +310,267 @@ func spacing(s1, s2 string) string {
 	return spacing
 }
 
-func createConnectedCallback(h *shared.History) func(c shared.Client) {
-	return func(c shared.Client) {
-		self := c.GetSelf()
-		peer := c.GetPeer()
+// chat reads the lines the user enters and sends them to the active session
+func chat(p *prompt, c shared.Client, h *shared.History) {
+	self := c.GetSelf()
+	for {
+		text, err := p.readLine()
+		if err != nil {
+			return
+		}
+		p.submitted(c)
+		if text == "" {
+			fmt.Fprintln(p.t, "  No empty messages allowed")
+			continue
+		}
 
-		fmt.Printf("  Connected to %s over an encrypted channel\n", peer.Username)
-		// start chat process
-		go func() {
-			for {
-				fmt.Printf("  %s > ", self.Username)
-				r := bufio.NewReader(os.Stdin)
-				bytes, _, _ := r.ReadLine()
-				text := string(bytes)
-				for text == "" {
-					fmt.Println("  No empty messages allowed")
-					fmt.Print("  > ")
-					r = bufio.NewReader(os.Stdin)
-					bytes, _, _ := r.ReadLine()
-					text = string(bytes)
-				}
-
-				spacing := spacing(self.Username, peer.Username)
-				h.Add(fmt.Sprintf("%s%s >         %s", self.Username, spacing, text))
-				c.GetPeerConn().Send(&shared.Message{
-					Type:    "message",
-					PeerID:  self.ID,
-					Content: text,
-				})
+		command, args := text, ""
+		if i := strings.Index(text, " "); i >= 0 {
+			command, args = text[:i], strings.TrimSpace(text[i+1:])
+		}
+		switch command {
+		case "/verify":
+			verify(p.t, c, p.getActive(), args)
+			continue
+		case "/send":
+			sendFile(p, c, p.getActive(), args)
+			continue
+		case "/accept":
+			acceptFile(p, c, args)
+			continue
+		case "/connect":
+			connectPeer(p, c, args)
+			continue
+		case "/peers":
+			listPeers(p, c)
+			continue
+		case "/switch":
+			switchPeer(p, c, args)
+			continue
+		case "/leave":
+			leave(p, c)
+			continue
+		case "/create":
+			if err := c.CreateRoom(); err != nil {
+				p.printf("  %s\n", err)
 			}
-		}()
+			continue
+		case "/join":
+			if err := c.JoinRoom(args); err != nil {
+				p.printf("  %s\n", err)
+			}
+			continue
+		case "/mail":
+			sendMail(p, c, h, args)
+			continue
+		}
+
+		if r := p.getRoom(); r != nil {
+			chat, err := c.SendRoomMessage(r.GetID(), text)
+			if err != nil {
+				fmt.Fprintf(p.t, "  could not send message: %s\n", err)
+				continue
+			}
+			h.Add(fmt.Sprintf("%s > #%s [%s] %s", self.Username, r.GetID(), chat.ID, chat.Text))
+			continue
+		}
+
+		s := p.getActive()
+		if s == nil {
+			fmt.Fprintln(p.t, "  there is no active conversation, type /connect <PeerID> to start one")
+			continue
+		}
+		peer := s.GetPeer()
+		chat, err := c.SendMessage(peer.ID, text)
+		if err != nil {
+			fmt.Fprintf(p.t, "  could not send message: %s\n", err)
+			continue
+		}
+		spacing := spacing(self.Username, peer.Username)
+		h.Add(fmt.Sprintf("%s%s > %s [%s] %s", self.Username, spacing, peer.Username, chat.ID, chat.Text))
 	}
 }
 
-func createMessageCallback(h *shared.History) func(c shared.Client, text string) {
-	return func(c shared.Client, text string) {
-		pUsername := c.GetPeer().Username
+func createConnectedCallback(h *shared.History, p *prompt) func(c shared.Client, s *shared.Session) {
+	return func(c shared.Client, s *shared.Session) {
+		peer := s.GetPeer()
+
+		p.printf("  Connected to %s over an encrypted channel\n", peer.Username)
+		if !c.GetVerifiedPeers().IsVerified(peer.ID) {
+			p.printf("  This peer is not verified, type /verify to see your safety number\n")
+		}
+
+		// a conversation the user started is the one they want to type in
+		if s.Dialed() || (p.getActive() == nil && p.getRoom() == nil) {
+			p.setActive(c, s)
+		} else {
+			p.printf("  type /switch %s to talk to %s\n", peer.Username, peer.Username)
+		}
+
+		// start chat process
+		if p.start(c) {
+			go chat(p, c, h)
+		}
+	}
+}
+
+// createDisconnectedCallback moves the prompt to another conversation when
+// the active one ends
+func createDisconnectedCallback(p *prompt) func(c shared.Client, s *shared.Session, reason string) {
+	return func(c shared.Client, s *shared.Session, reason string) {
+		p.printf("  Disconnected from %s: %s\n", s.GetPeer().Username, reason)
+		if !p.started() {
+			// nothing connected yet, offer the menu again
+			go registeredCallback(c)
+			return
+		}
+		if p.getActive() == s {
+			switchNext(p, c)
+		}
+	}
+}
+
+func createMessageCallback(h *shared.History, p *prompt) func(c shared.Client, s *shared.Session, chat *shared.Chat) {
+	return func(c shared.Client, s *shared.Session, chat *shared.Chat) {
+		pUsername := s.GetPeer().Username
 		spacing := spacing(pUsername, c.GetSelf().Username)
-		h.Add(fmt.Sprintf("%s%s < %s", pUsername, spacing, text))
+		h.Add(fmt.Sprintf("%s%s < [%s] %s", pUsername, spacing, chat.ID, chat.Text))
+		// the history is what the user reads so the message has been displayed
+		c.MarkRead(s.GetPeer().ID, chat.ID)
+		if p.getActive() != s {
+			p.printf("  new message from %s, type /switch %s to answer\n", pUsername, pUsername)
+		}
+	}
+}
+
+// createRoomCallback switches to the rooms the user creates or joins and
+// reports changes of their members
+func createRoomCallback(h *shared.History, p *prompt) func(c shared.Client, r *shared.Room) {
+	joined := make(map[*shared.Room]bool)
+	m := &sync.Mutex{}
+
+	return func(c shared.Client, r *shared.Room) {
+		if _, ok := c.GetRooms().Get(r.GetID()); !ok {
+			p.printf("  left #%s\n", r.GetID())
+			if p.getRoom() == r {
+				switchNext(p, c)
+			}
+			return
+		}
+
+		var names []string
+		for _, member := range r.GetMembers() {
+			names = append(names, member.Username)
+		}
+		p.printf("  #%s members: %s\n", r.GetID(), strings.Join(names, ", "))
+
+		m.Lock()
+		first := !joined[r]
+		joined[r] = true
+		m.Unlock()
+		if !first {
+			return
+		}
+
+		p.printf("  give others the room ID %s to join\n", r.GetID())
+		p.setRoom(c, r)
+		if p.start(c) {
+			go chat(p, c, h)
+		}
+	}
+}
+
+func createRoomMessageCallback(h *shared.History, p *prompt) func(c shared.Client, r *shared.Room, peer *shared.Peer, chat *shared.Chat) {
+	return func(c shared.Client, r *shared.Room, peer *shared.Peer, chat *shared.Chat) {
+		h.Add(fmt.Sprintf("%s @ #%s < [%s] %s", peer.Username, r.GetID(), chat.ID, chat.Text))
+		if p.getRoom() != r {
+			p.printf("  new message in #%s, type /switch %s to answer\n", r.GetID(), r.GetID())
+		}
+	}
+}
+
+// createMailCallback shows the mail that was left for the user while they
+// were offline
+func createMailCallback(h *shared.History, p *prompt) func(c shared.Client, peer *shared.Peer, chat *shared.Chat, sentAt time.Time) {
+	return func(c shared.Client, peer *shared.Peer, chat *shared.Chat, sentAt time.Time) {
+		h.Add(fmt.Sprintf("%s (mail %s) < [%s] %s", peer.Username, sentAt.Format("2006-01-02 15:04"), chat.ID, chat.Text))
+		p.printf("  mail from %s (%s), type /connect %s to answer\n", peer.Username, peer.ID, peer.ID)
+	}
+}
+
+// createErrorCallback prints the errors the user can act on. Fatal errors end
+// the program and a request the server refused before any conversation
+// started brings the menu back.
+func createErrorCallback(p *prompt) func(c shared.Client, e *shared.Error) {
+	return func(c shared.Client, e *shared.Error) {
+		c.GetLog().Printf("%s error handling %s message: %s", e.Kind, e.Type, e)
+		switch {
+		case e.Kind == shared.FatalError:
+			p.restore()
+			fmt.Printf("  %s\n", e)
+			os.Exit(1)
+		case e.Kind == shared.IgnorableError && e.FromServer(c):
+			p.printf("  %s\n", e)
+			var pe *shared.ProtocolError
+			if !errors.As(e, &pe) {
+				pe = &shared.ProtocolError{}
+			}
+			if pe.RetryAfter > 0 {
+				p.printf("  try again in %s\n", pe.RetryAfter.Round(time.Second))
+			}
+			if !p.started() {
+				go registeredCallback(c)
+				return
+			}
+			if pe.Code == shared.PeerNotFound && pe.Details["peerID"] != "" {
+				p.printf("  type /mail %s <message> to leave a message\n", pe.Details["peerID"])
+			}
+		}
+	}
+}
+
+func createReceiptCallback(h *shared.History) func(c shared.Client, s *shared.Session, r *shared.Receipt) {
+	return func(c shared.Client, s *shared.Session, r *shared.Receipt) {
+		h.Add(fmt.Sprintf("  [%s] %s", r.ID, r.State))
+	}
+}
+
+func createPeerSignalCallback(p *prompt) func(c shared.Client, s *shared.Session, sig *shared.Signal) {
+	return func(c shared.Client, s *shared.Session, sig *shared.Signal) {
+		if sig.Name == shared.TypingSignal {
+			p.showTyping(s, sig.Active)
+		}
+	}
+}
+
+func createFileOfferCallback(p *prompt) func(c shared.Client, s *shared.Session, t *shared.Transfer) {
+	return func(c shared.Client, s *shared.Session, t *shared.Transfer) {
+		p.printf("  %s offers %s (%d bytes), type /accept %s %s to download it\n", s.GetPeer().Username, t.Name, t.Size, s.GetPeer().Username, t.ID)
+	}
+}
+
+func createFileProgressCallback(p *prompt) func(c shared.Client, s *shared.Session, t *shared.Transfer) {
+	// only print every tenth of a file
+	shown := make(map[string]int64)
+	m := &sync.Mutex{}
+
+	return func(c shared.Client, s *shared.Session, t *shared.Transfer) {
+		switch {
+		case t.Error != "":
+			p.printf("  transfer of %s failed: %s\n", t.Name, t.Error)
+		case t.Complete && t.Sending:
+			p.printf("  sent %s\n", t.Name)
+		case t.Complete:
+			p.printf("  received %s\n", t.Path())
+		case t.Size > 0:
+			tenth := t.Offset * 10 / t.Size
+			m.Lock()
+			last, ok := shown[t.ID]
+			shown[t.ID] = tenth
+			m.Unlock()
+			if !ok || tenth != last {
+				p.printf("  %s %d%%\n", t.Name, tenth*10)
+			}
+		}
 	}
 }
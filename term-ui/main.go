@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -20,9 +21,21 @@ const (
 )
 
 var (
-	serverTCPIP = "0.0.0.0"
-	serverUDPIP = "127.0.0.1"
-	serverIP    = flag.String("serverIP", "", "IP address of rendezvous server")
+	serverTCPIP    = "0.0.0.0"
+	serverUDPIP    = "127.0.0.1"
+	serverIP       = flag.String("serverIP", "", "IP address of rendezvous server")
+	identity       = flag.String("identity", "", "Path of the identity key file to use")
+	rekeyCount     = flag.Uint64("rekeyMessages", shared.DefaultRekeyPolicy.Messages, "Rotate session keys after this many messages (0 disables)")
+	rekeyTime      = flag.Duration("rekeyInterval", shared.DefaultRekeyPolicy.Interval, "Rotate session keys after this long (0 disables)")
+	keepalive      = flag.Duration("keepalive", shared.DefaultKeepalivePolicy.Interval, "Ping the peer this often (0 disables)")
+	maxMissed      = flag.Int("maxMissed", shared.DefaultKeepalivePolicy.MaxMissed, "Disconnect after this many unanswered pings")
+	punchAttempts  = flag.Int("punchAttempts", shared.DefaultPunchStrategy.Attempts, "Give up punching through to a peer after this many attempts")
+	punchIntervals = flag.String("punchIntervals", "3s", "Comma separated waits between punch attempts, the last one repeats")
+	punchBurst     = flag.Int("punchBurst", shared.DefaultPunchStrategy.Burst, "Send the first punch this many times")
+	punchJitter    = flag.Duration("punchJitter", shared.DefaultPunchStrategy.Jitter, "Add up to this much at random to each wait")
+	punchDeadline  = flag.Duration("punchDeadline", shared.DefaultPunchStrategy.Deadline, "Give up punching after this long (0 leaves it to the attempts)")
+	punchTTL       = flag.Int("punchTTL", shared.DefaultPunchStrategy.LowTTL, "Send the first punches with this low TTL (0 disables)")
+	punchTTLCount  = flag.Int("punchTTLAttempts", shared.DefaultPunchStrategy.LowTTLAttempts, "How many of the first punch attempts use the low TTL")
 )
 
 func main() {
@@ -50,6 +63,24 @@ func main() {
 		fmt.Print("\n")
 	}
 
+	// pick the identity to connect with
+	path := *identity
+	if path == "" {
+		fmt.Println("  Identity file (empty for a temporary identity)")
+		fmt.Print("  > ")
+		fmt.Scanln(&path)
+		fmt.Print("\n")
+	}
+
+	var store *shared.IdentityStore
+	if path != "" {
+		store, err = shared.OpenIdentityStore(path, "  Passphrase > ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print("\n")
+	}
+
 	// create message history
 	wd, err := os.Getwd()
 	if err != nil {
@@ -63,6 +94,7 @@ func main() {
 	defer hf.Close()
 
 	h := shared.NewHistory(hf)
+	p := newPrompt()
 
 	var c shared.Client
 	var sAddr *net.UDPAddr
@@ -78,29 +110,62 @@ func main() {
 			log.Fatal(err)
 		}
 
-		c, err = udp_client.New(username, addr, sAddr)
+		c, err = udp_client.New(username, store, addr, sAddr)
 		return err
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	policy := shared.DefaultRekeyPolicy
+	policy.Messages = *rekeyCount
+	policy.Interval = *rekeyTime
+	c.SetRekeyPolicy(policy)
+	c.SetKeepalivePolicy(shared.KeepalivePolicy{
+		Interval:  *keepalive,
+		MaxMissed: *maxMissed,
+	})
+	intervals, err := shared.ParseIntervals(*punchIntervals)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.SetPunchStrategy(shared.PunchStrategy{
+		Attempts:       *punchAttempts,
+		Intervals:      intervals,
+		Burst:          *punchBurst,
+		Jitter:         *punchJitter,
+		Deadline:       *punchDeadline,
+		LowTTL:         *punchTTL,
+		LowTTLAttempts: *punchTTLCount,
+	})
+
 	c.OnRegistered(registeredCallback)
-	c.OnConnecting(connectingCallback)
-	c.OnConnected(createConnectedCallback(h))
-	c.OnMessage(createMessageCallback(h))
+	c.OnConnecting(createConnectingCallback(p))
+	c.OnConnected(createConnectedCallback(h, p))
+	c.OnDisconnected(createDisconnectedCallback(p))
+	c.OnMessage(createMessageCallback(h, p))
+	c.OnReceipt(createReceiptCallback(h))
+	c.OnPeerSignal(createPeerSignalCallback(p))
+	c.OnFileOffer(createFileOfferCallback(p))
+	c.OnFileProgress(createFileProgressCallback(p))
+	c.OnRoom(createRoomCallback(h, p))
+	c.OnRoomMessage(createRoomMessageCallback(h, p))
+	c.OnMail(createMailCallback(h, p))
+	c.OnError(createErrorCallback(p))
 
 	fmt.Println("  ID")
 	fmt.Printf("  > %s\n\n", c.GetSelf().ID)
 
-	err = c.Start()
+	err = c.Start(context.Background())
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	exit := make(chan os.Signal)
 	signal.Notify(exit, syscall.SIGINT, syscall.SIGTERM)
-	log.Println(<-exit)
+	sig := <-exit
+	p.restore()
+	log.Println(sig)
 
 	c.Stop()
 }
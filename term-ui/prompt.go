@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/wilfreddenton/udp-hole-punching/shared"
+	"golang.org/x/term"
+)
+
+// typingIdle is how long the user can pause before they stop typing
+const typingIdle = 3 * time.Second
+
+// prompt is the line the user types messages into. The terminal is put in
+// raw mode so that every key press can be reported to the peer. Lines go to
+// the active session or room, the others wait until the user switches to
+// them.
+type prompt struct {
+	t        *term.Terminal
+	state    *term.State
+	username string
+	active   *shared.Session
+	room     *shared.Room
+	typing   *time.Timer // stops the user's typing signal
+	shown    *time.Timer // hides the peer's typing indicator
+	m        *sync.Mutex
+}
+
+// start puts the terminal in raw mode. It returns false when the prompt
+// has already been started.
+func (p *prompt) start(c shared.Client) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.t != nil {
+		return false
+	}
+	p.username = c.GetSelf().Username
+
+	state, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err == nil {
+		p.state = state
+	}
+
+	p.t = term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, p.line(false))
+
+	p.t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		p.keyPressed(c)
+		return "", 0, false
+	}
+	return true
+}
+
+func (p *prompt) started() bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.t != nil
+}
+
+// line is the prompt text for the active session, p.m must be held
+func (p *prompt) line(typing bool) string {
+	if p.room != nil {
+		return fmt.Sprintf("  %s @ #%s > ", p.username, p.room.GetID())
+	}
+	if p.active == nil {
+		return fmt.Sprintf("  %s > ", p.username)
+	}
+	peer := p.active.GetPeer().Username
+	if typing {
+		return fmt.Sprintf("  (%s is typing) %s @ %s > ", peer, p.username, peer)
+	}
+	return fmt.Sprintf("  %s @ %s > ", p.username, peer)
+}
+
+func (p *prompt) getActive() *shared.Session {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.active
+}
+
+func (p *prompt) getRoom() *shared.Room {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.room
+}
+
+// setRoom sends the lines the user enters to the room
+func (p *prompt) setRoom(c shared.Client, r *shared.Room) {
+	p.setActive(c, nil)
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.room = r
+	if p.t != nil {
+		p.t.SetPrompt(p.line(false))
+	}
+}
+
+// setActive switches the conversation lines are sent to, a nil session
+// leaves the user without one
+func (p *prompt) setActive(c shared.Client, s *shared.Session) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.room = nil
+	if p.active == s {
+		if p.t != nil {
+			p.t.SetPrompt(p.line(false))
+		}
+		return
+	}
+	// the previous peer should not think the user is still typing to it
+	if p.typing != nil && p.typing.Stop() && p.active != nil {
+		go c.SendSignal(p.active.GetPeer().ID, shared.TypingSignal, false)
+	}
+	if p.shown != nil {
+		p.shown.Stop()
+	}
+	p.active = s
+	if p.t != nil {
+		p.t.SetPrompt(p.line(false))
+	}
+}
+
+// keyPressed tells the active peer the user is typing until they go idle
+func (p *prompt) keyPressed(c shared.Client) {
+	p.m.Lock()
+	if p.active == nil {
+		p.m.Unlock()
+		return
+	}
+	peerID := p.active.GetPeer().ID
+	if p.typing != nil {
+		p.typing.Stop()
+	}
+	p.typing = time.AfterFunc(typingIdle, func() {
+		c.SendSignal(peerID, shared.TypingSignal, false)
+	})
+	p.m.Unlock()
+
+	c.SendSignal(peerID, shared.TypingSignal, true)
+}
+
+// submitted tells the active peer the user has stopped typing
+func (p *prompt) submitted(c shared.Client) {
+	p.m.Lock()
+	if p.typing != nil {
+		p.typing.Stop()
+	}
+	active := p.active
+	p.m.Unlock()
+	if active != nil {
+		c.SendSignal(active.GetPeer().ID, shared.TypingSignal, false)
+	}
+}
+
+// showTyping adds the typing indicator of the peer of s to the prompt when s
+// is the active session
+func (p *prompt) showTyping(s *shared.Session, active bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.t == nil || p.active != s {
+		return
+	}
+
+	if p.shown != nil {
+		p.shown.Stop()
+	}
+	p.t.SetPrompt(p.line(active))
+	if !active {
+		return
+	}
+
+	p.shown = time.AfterFunc(shared.SignalTimeout, func() {
+		p.showTyping(s, false)
+	})
+}
+
+// printf writes a line above the prompt
+func (p *prompt) printf(format string, a ...interface{}) {
+	p.m.Lock()
+	t := p.t
+	p.m.Unlock()
+	if t == nil {
+		fmt.Printf(format, a...)
+		return
+	}
+	fmt.Fprintf(t, format, a...)
+}
+
+// readLine returns the next line the user entered. On ctrl-c or ctrl-d the
+// terminal is restored and the process is interrupted.
+func (p *prompt) readLine() (string, error) {
+	line, err := p.t.ReadLine()
+	if err == io.EOF {
+		p.restore()
+		syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	}
+	return line, err
+}
+
+func (p *prompt) restore() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.state != nil {
+		term.Restore(int(os.Stdin.Fd()), p.state)
+		p.state = nil
+	}
+}
+
+func newPrompt() *prompt {
+	return &prompt{m: &sync.Mutex{}}
+}
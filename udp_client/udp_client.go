@@ -1,7 +1,9 @@
 package udp_client
 
 import (
-	"encoding/base64"
+	"context"
+	"errors"
+	"fmt"
 	"net"
 	"time"
 
@@ -15,32 +17,337 @@ type Client struct {
 	sAddr *net.UDPAddr
 }
 
-func (c *Client) Connect() {
+// Connect punches through to the peer of a new session and runs its
+// handshake the way the punch strategy says, starting when the server asked
+// both peers to. It gives up when ctx is done and reports how punching went
+// to the punch callback.
+func (c *Client) Connect(ctx context.Context, s *shared.Session) {
 	l := c.GetLog()
-	self := c.GetSelf()
-	peer := c.GetPeer()
-	pConn := c.GetPeerConn()
+	peer := s.GetPeer()
+	pConn := s.GetConn()
 
-	for i := 0; i < 5; i += 1 {
-		if c.WasKeyReceived() {
+	strategy := c.GetPunchStrategy()
+	if strategy.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, strategy.Deadline)
+		defer cancel()
+	}
+
+	start := time.Now()
+	attempts, lowTTL := 0, 0
+	var mode shared.PunchMode
+	result := func(outcome shared.PunchOutcome, err error) *shared.PunchResult {
+		return &shared.PunchResult{
+			Outcome:        outcome,
+			Mode:           mode,
+			Attempts:       attempts,
+			LowTTLAttempts: lowTTL,
+			Elapsed:        time.Since(start),
+			Err:            err,
+		}
+	}
+
+	// stop gives up once ctx is done
+	stop := func() {
+		outcome := shared.PunchCancelled
+		if ctx.Err() == context.DeadlineExceeded {
+			outcome = shared.PunchTimedOut
+		}
+		l.Printf("stopped punching through to peer %s: %s", peer.Username, outcome)
+		c.givePunchUp(s, result(outcome, ctx.Err()), fmt.Sprintf("punching through to %s %s", peer.Username, outcome))
+	}
+
+	// the server picks a moment for both peers to start so that neither NAT
+	// sees the other's first packets before it has punched out itself
+	if wait := time.Until(s.PunchAt()); wait > shared.MaxPunchDelay {
+		l.Printf("not waiting %s to punch through to peer %s", wait.Round(time.Millisecond), peer.Username)
+	} else if wait > 0 {
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			stop()
+			return
+		case <-t.C:
+		}
+	}
+
+	ready := s.Ready()
+	for {
+		// the session may have been ended while punching
+		if !c.GetSessions().Active(s) {
+			c.PunchCallback(c, s, result(shared.PunchCancelled, nil))
+			return
+		}
+
+		h := pConn.GetHandshake()
+		if h != nil && h.Complete() {
 			// tell user that client connected to peer
-			l.Printf("connected to peer %s", peer.Username)
-			c.ConnectedCallback(c)
+			l.Printf("connected to peer %s after %d attempts (%s)", peer.Username, attempts, mode)
+			c.PunchCallback(c, s, result(shared.PunchConnected, nil))
+			go c.rekey(s)
+			go c.keepalive(s)
+			c.ConnectedCallback(c, s)
+			// continue any file the peer did not completely receive
+			c.ResumeTransfers(peer.ID)
+			// the peer may be waiting for the key of a room
+			c.ShareRoomKeys(peer.ID)
+			return
+		}
+
+		if attempts >= strategy.Attempts && attempts > 0 {
+			l.Printf("could not connect to peer %s at %s", peer.Username, pConn.GetAddr())
+			c.givePunchUp(s, result(shared.PunchExhausted, nil), "could not reach "+peer.Username)
+			return
+		}
+
+		mode = strategy.Mode(attempts)
+		var m *shared.Message
+		if mode == shared.PunchLowTTL {
+			// only opens the mapping, the handshake message would be lost
+			lowTTL += 1
+			m = &shared.Message{
+				Type:   "connect",
+				PeerID: c.GetSelf().ID,
+				TTL:    strategy.LowTTL,
+			}
+		} else {
+			var err error
+			m, err = c.punch(h)
+			if err != nil {
+				l.Print(err)
+				c.givePunchUp(s, result(shared.PunchFailed, err), "could not connect to "+peer.Username)
+				return
+			}
+		}
+
+		// the first attempt that is meant to arrive may be sent several times
+		// in case the first packets are dropped while the NATs open their
+		// mappings
+		copies := 1
+		first := attempts == 0 || strategy.Mode(attempts-1) == shared.PunchLowTTL
+		if mode == shared.PunchNormal && first && strategy.Burst > 1 {
+			copies = strategy.Burst
+		}
+		l.Printf("punching through to peer %s at %s (%s)", peer.Username, pConn.GetAddr(), mode)
+		for i := 0; i < copies; i += 1 {
+			pConn.Send(m)
+		}
+
+		t := time.NewTimer(strategy.Wait(attempts))
+		attempts += 1
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			stop()
+			return
+		case <-ready:
+			// report the connection as soon as the keys are in place instead
+			// of at the next attempt, a restarted handshake waits as before
+			t.Stop()
+			ready = nil
+		case <-t.C:
+		}
+	}
+}
+
+// punch returns the pending handshake message, which also punches the hole,
+// or a bare punch while waiting for the peer to start the handshake
+func (c *Client) punch(h *shared.Handshake) (*shared.Message, error) {
+	m := &shared.Message{
+		Type:   "connect",
+		PeerID: c.GetSelf().ID,
+	}
+	if h == nil {
+		return m, nil
+	}
+
+	hm, err := h.Next()
+	if err != nil {
+		return nil, err
+	}
+	if hm != nil {
+		m = &shared.Message{
+			Type:    "handshake",
+			PeerID:  c.GetSelf().ID,
+			Content: hm,
+		}
+	}
+	return m, nil
+}
+
+// givePunchUp ends a session whose peer could not be reached
+func (c *Client) givePunchUp(s *shared.Session, r *shared.PunchResult, reason string) {
+	c.PunchCallback(c, s, r)
+	if c.EndSession(s) {
+		c.DisconnectedCallback(c, s, reason)
+	}
+}
+
+// rekey rotates the keys of a session whenever the rekey policy asks for it
+func (c *Client) rekey(s *shared.Session) {
+	l := c.GetLog()
+	ctx := c.Context()
+	pConn := s.GetConn()
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		// stop once the session has ended
+		if !c.GetSessions().Active(s) {
 			return
 		}
 
-		l.Printf("punching through to peer %s at %s", peer.Username, pConn.GetAddr())
+		cipher, err := pConn.GetCipher()
+		if err != nil {
+			continue
+		}
+		rc, ok := cipher.(*shared.RotatingCipher)
+		if !ok || !rc.NeedsRekey() {
+			continue
+		}
+
+		r, err := rc.StartRekey()
+		if err != nil {
+			l.Print(err)
+			continue
+		}
+
+		l.Printf("requesting rekey of session with peer %s to epoch %d", s.GetPeer().Username, r.Epoch)
 		pConn.Send(&shared.Message{
-			Type:   "connect",
-			PeerID: self.ID,
+			Type:    "rekey",
+			PeerID:  c.GetSelf().ID,
+			Content: r,
+			Encrypt: true,
 		})
-		time.Sleep(3 * time.Second)
 	}
+}
+
+// keepalive pings the peer of a session every interval of the keepalive
+// policy and ends the session once too many pings in a row go unanswered
+func (c *Client) keepalive(s *shared.Session) {
+	p := c.GetKeepalivePolicy()
+	if p.Interval <= 0 {
+		return
+	}
+
+	l := c.GetLog()
+	ctx := c.Context()
+	pConn := s.GetConn()
+	liveness := pConn.GetLiveness()
+	liveness.Seen()
+	t := time.NewTicker(p.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if !c.GetSessions().Active(s) {
+			return
+		}
+
+		if missed := liveness.Ping(); missed >= p.MaxMissed {
+			l.Printf("peer %s missed %d keepalives, last seen %s", s.GetPeer().Username, missed, liveness.LastSeen().Format(time.RFC3339))
+			if c.EndSession(s) {
+				c.DisconnectedCallback(c, s, "peer stopped responding")
+			}
+			return
+		}
+
+		pConn.Send(&shared.Message{
+			Type:    "ping",
+			PeerID:  c.GetSelf().ID,
+			Encrypt: true,
+		})
+	}
+}
+
+// greet runs the handshake with the rendezvous server, repeating handshake
+// messages until the server answers over the transport keys
+func (c *Client) greet(sConn shared.Conn) {
+	l := c.GetLog()
+	ctx := c.Context()
+	h := sConn.GetHandshake()
 
-	l.Printf("could not connect to peer %s at %s", peer.Username, pConn.GetAddr())
+	for i := 0; i < 5; i += 1 {
+		hm, err := h.Next()
+		if err != nil {
+			l.Print(err)
+			return
+		}
+		if hm == nil {
+			return
+		}
+
+		sConn.Send(&shared.Message{
+			Type:    "handshake",
+			PeerID:  c.GetSelf().ID,
+			Content: hm,
+		})
+		// the register message is lost if it arrives before the last
+		// handshake message so send it again as well
+		if h.Complete() {
+			sConn.Send(shared.RegisterMessage(c.GetSelf()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(3 * time.Second):
+		}
+	}
+
+	// without the handshake the client can not register
+	if !h.Complete() {
+		c.ErrorCallback(c, &shared.Error{
+			Kind: shared.FatalError,
+			Type: "handshake",
+			Conn: sConn,
+			Err:  errors.New("could not complete the handshake with the rendezvous server"),
+		})
+		return
+	}
+	l.Print("the rendezvous server has not confirmed the handshake")
+}
+
+// reregister registers with the rendezvous server again every keepalive
+// interval. It keeps the NAT mapping to the server open and lets the server
+// follow the client to a new address.
+func (c *Client) reregister(sConn shared.Conn) {
+	p := c.GetKeepalivePolicy()
+	if p.Interval <= 0 {
+		return
+	}
+
+	ctx := c.Context()
+	t := time.NewTicker(p.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if _, err := sConn.GetCipher(); err != nil {
+			continue
+		}
+		sConn.Send(shared.RegisterMessage(c.GetSelf()))
+	}
 }
 
-func (c *Client) Start() error {
+// Start connects the client to the rendezvous server. The client stops when
+// ctx is done.
+func (c *Client) Start(ctx context.Context) error {
+	c.SetContext(ctx)
 	s := c.GetServer()
 
 	// add rendezvous server connection
@@ -51,32 +358,31 @@ func (c *Client) Start() error {
 
 	c.SetServerConn(sConn)
 
-	// get public key
-	pubKey, err := c.GetSelf().GetPublicKey()
+	// get static keys
+	kp, err := c.GetSelf().GetKeyPair()
 	if err != nil {
 		return err
 	}
+	sConn.SetHandshake(shared.NewHandshake(true, kp))
 
 	// start server
 	go s.Listen()
 
-	// send greeting message to server
-	sConn.Send(&shared.Message{
-		Type:    "greeting",
-		Content: base64.StdEncoding.EncodeToString(pubKey[:]),
-	})
+	// start the handshake with the server
+	go c.greet(sConn)
+	go c.reregister(sConn)
 
 	return nil
 }
 
-func New(username string, addr *net.UDPAddr, sAddr *net.UDPAddr) (*Client, error) {
+func New(username string, store *shared.IdentityStore, addr *net.UDPAddr, sAddr *net.UDPAddr) (*Client, error) {
 	// create udp server
 	s, err := udp_server.New(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	bc, err := base_client.New(username, s)
+	bc, err := base_client.New(username, store, s)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,16 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package udp_server
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// setTTL makes the socket send its packets with the TTL and returns a
+// function that puts back the previous one
+func setTTL(c *net.UDPConn, ttl int) (func() error, error) {
+	return nil, fmt.Errorf("setting the TTL is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,74 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package udp_server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+type sockopt struct {
+	level, name int
+}
+
+// the TTL of IPv4 packets and the hop limit of IPv6 ones, a socket listening
+// on both sends either
+var ttlOptions = []sockopt{
+	{syscall.IPPROTO_IP, syscall.IP_TTL},
+	{syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS},
+}
+
+// setTTL makes the socket send its packets with the TTL and returns a
+// function that puts back the previous one
+func setTTL(c *net.UDPConn, ttl int) (func() error, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var set []sockopt
+	var prev []int
+	restore := func() error {
+		var serr error
+		err := rc.Control(func(fd uintptr) {
+			for i, o := range set {
+				if err := syscall.SetsockoptInt(int(fd), o.level, o.name, prev[i]); err != nil {
+					serr = err
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		for _, o := range ttlOptions {
+			// an IPv4 socket has no hop limit
+			v, err := syscall.GetsockoptInt(int(fd), o.level, o.name)
+			if err != nil {
+				continue
+			}
+			if serr = syscall.SetsockoptInt(int(fd), o.level, o.name, ttl); serr != nil {
+				return
+			}
+			set = append(set, o)
+			prev = append(prev, v)
+		}
+	})
+	if err == nil {
+		err = serr
+	}
+	if err == nil && len(set) == 0 {
+		err = errors.New("the socket has no TTL to set")
+	}
+	if err != nil {
+		restore()
+		return nil, err
+	}
+	return restore, nil
+}
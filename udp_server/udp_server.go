@@ -2,21 +2,35 @@ package udp_server
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/wilfreddenton/udp-hole-punching/shared"
 )
 
 type Server struct {
 	c               *net.UDPConn
 	conns           shared.Conns
+	sessions        map[shared.SessionID]*shared.UDPConn
+	paths           map[string]*path
+	fragments       *shared.Reassembler
 	send            chan *shared.UDPPayload
-	messageCallback func(shared.Conns, shared.Conn, *shared.Message)
+	messageCallback func(shared.Conn, *shared.Message)
+	migrateCallback func(shared.Conn, net.Addr)
 	exit            chan bool
 	wg              *sync.WaitGroup
+	m               *sync.Mutex // guards conns, sessions and paths
+}
+
+// path is a new address of a session that has not yet answered its challenge
+type path struct {
+	conn *shared.UDPConn
+	addr *net.UDPAddr
+	done chan struct{}
 }
 
 func (s *Server) sender() {
@@ -26,10 +40,11 @@ func (s *Server) sender() {
 	for {
 		select {
 		case <-s.exit:
+			s.drain()
 			log.Print("exiting UDP sender")
 			return
 		case p := <-s.send:
-			_, err := s.c.WriteToUDP(p.Bytes, p.Addr)
+			err := s.write(p)
 			if err != nil {
 				log.Print(err)
 			}
@@ -37,17 +52,207 @@ func (s *Server) sender() {
 	}
 }
 
-func (s *Server) serve(b []byte, c shared.Conn) {
+// write sends a payload, with its own TTL when it has one. Only the sender
+// writes so the TTL does not leak into other packets.
+func (s *Server) write(p *shared.UDPPayload) error {
+	if p.TTL <= 0 {
+		_, err := s.c.WriteToUDP(p.Bytes, p.Addr)
+		return err
+	}
+
+	// a packet that is meant to expire on the way must not be sent with the
+	// normal TTL instead
+	restore, err := setTTL(s.c, p.TTL)
+	if err != nil {
+		return fmt.Errorf("could not send packet with TTL %d: %w", p.TTL, err)
+	}
+	_, err = s.c.WriteToUDP(p.Bytes, p.Addr)
+	if rerr := restore(); rerr != nil {
+		return fmt.Errorf("could not restore TTL: %w", rerr)
+	}
+	return err
+}
+
+// drain writes what is already queued, such as a disconnect message
+func (s *Server) drain() {
+	for {
+		select {
+		case p := <-s.send:
+			s.write(p)
+		default:
+			return
+		}
+	}
+}
+
+// session returns the Conn of the session a packet was sealed by
+func (s *Server) session(b []byte) (*shared.UDPConn, bool) {
+	id, ok := shared.PacketSession(b)
+	if !ok {
+		return nil, false
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	c, ok := s.sessions[id]
+	return c, ok
+}
+
+// track remembers the session of an authenticated packet and starts to
+// validate the address it came from when the session is at another one
+func (s *Server) track(c *shared.UDPConn, b []byte, addr *net.UDPAddr) {
+	id, _ := shared.PacketSession(b)
+	s.m.Lock()
+	if _, ok := s.sessions[id]; !ok {
+		s.sessions[id] = c
+	}
+	if c.GetAddr().String() == addr.String() {
+		s.m.Unlock()
+		return
+	}
+	for _, p := range s.paths {
+		if p.conn == c && p.addr.String() == addr.String() {
+			s.m.Unlock()
+			return
+		}
+	}
+	token := shared.GenMessageID()
+	p := &path{conn: c, addr: addr, done: make(chan struct{})}
+	s.paths[token] = p
+	s.m.Unlock()
+
+	go s.validate(token, p)
+}
+
+// validate challenges a new address of a session until it answers or the
+// retries run out, in which case the session stays where it was
+func (s *Server) validate(token string, p *path) {
+	defer func() {
+		s.m.Lock()
+		delete(s.paths, token)
+		s.m.Unlock()
+	}()
+
+	log.Printf("validating new address %s of session at %s", p.addr, p.conn.GetAddr())
+	for i := 0; i < shared.PathRetries; i += 1 {
+		err := p.conn.WriteTo(&shared.Message{
+			Type:    "challenge",
+			Content: &shared.PathChallenge{Token: token},
+			Encrypt: true,
+		}, p.addr)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+
+		select {
+		case <-p.done:
+			return
+		case <-s.exit:
+			return
+		case <-time.After(shared.PathTimeout):
+		}
+	}
+	log.Printf("new address %s did not answer its challenge", p.addr)
+}
+
+// migrate moves the session of c to addr once addr has echoed the token
+func (s *Server) migrate(c *shared.UDPConn, token string, addr *net.UDPAddr) {
+	s.m.Lock()
+	p, ok := s.paths[token]
+	if !ok || p.conn != c || p.addr.String() != addr.String() {
+		s.m.Unlock()
+		return
+	}
+	delete(s.paths, token)
+	close(p.done)
+
+	prev := c.GetAddr()
+	delete(s.conns, prev.String())
+	s.conns[addr.String()] = c
+	c.SetAddr(addr)
+	s.m.Unlock()
+
+	log.Printf("session moved from %s to %s", prev, addr)
+	s.migrateCallback(c, prev)
+}
+
+// answer handles the messages of path validation, it reports whether m was
+// one of them
+func (s *Server) answer(c *shared.UDPConn, m *shared.Message, addr *net.UDPAddr) bool {
+	if m.Type != "challenge" && m.Type != "response" {
+		return false
+	}
+	if !m.WasEncrypted() {
+		return true
+	}
+
+	var pc shared.PathChallenge
+	err := mapstructure.Decode(m.Content, &pc)
+	if err != nil {
+		log.Print(err)
+		return true
+	}
+
+	if m.Type == "challenge" {
+		c.Send(&shared.Message{
+			Type:    "response",
+			Content: &pc,
+			Encrypt: true,
+		})
+		return true
+	}
+	s.migrate(c, pc.Token, addr)
+	return true
+}
+
+func (s *Server) serve(b []byte, c *shared.UDPConn, addr *net.UDPAddr) {
 	defer s.wg.Done()
+
+	// a session that moved to a new address can still be found by its ID,
+	// the packet only counts if it opens with the session's keys
+	moved := false
+	if sc, ok := s.session(b); ok && sc != c {
+		c = sc
+		moved = true
+	}
+
 	m, err := shared.MessageIn(c, b)
 	if err != nil {
+		// the session is not at addr, a reply would go to its old address
+		if moved {
+			log.Printf("dropping malformed payload from %s", addr)
+			return
+		}
 		c.Send(&shared.Message{
 			Error: "Malformed payload was sent",
+			Code:  shared.Malformed,
 		})
 		return
 	}
 
-	go s.messageCallback(s.conns, c, m)
+	// once a Conn is encrypted only encrypted messages may touch its
+	// sequence numbers
+	if _, err := c.GetCipher(); err == nil && !m.WasEncrypted() && (m.Seq != 0 || m.Type == "ack") {
+		log.Printf("dropping unencrypted %s message from %s", m.Type, c.GetAddr())
+		return
+	}
+	// only the holder of the keys can prove that the other end is alive
+	if m.WasEncrypted() {
+		c.GetLiveness().Seen()
+		s.track(c, b, addr)
+	}
+	if s.answer(c, m, addr) {
+		return
+	}
+
+	// reliable messages are delivered in order from this goroutine
+	c.GetReliable().Receive(m, func(m *shared.Message) {
+		if m.Seq != 0 {
+			s.messageCallback(c, m)
+			return
+		}
+		go s.messageCallback(c, m)
+	})
 }
 
 func (s *Server) receiver() {
@@ -58,12 +263,11 @@ func (s *Server) receiver() {
 		select {
 		case <-s.exit:
 			log.Print("exiting UDP receiver")
-			s.c.Close()
 			return
 		default:
 		}
 
-		buf := make([]byte, 2048)
+		buf := make([]byte, shared.MaxDatagramSize)
 		s.c.SetDeadline(time.Now().Add(time.Second))
 		n, addr, err := s.c.ReadFromUDP(buf)
 		if err != nil {
@@ -71,20 +275,34 @@ func (s *Server) receiver() {
 				continue
 			}
 
+			s.m.Lock()
 			delete(s.conns, addr.String())
+			s.m.Unlock()
 			log.Print(err)
 			return
 		}
 
-		c, ok := s.conns[addr.String()]
+		s.m.Lock()
+		c, ok := s.conns[addr.String()].(*shared.UDPConn)
 		if !ok {
 			c = shared.NewUDPConn(s.send, addr)
 			s.conns[addr.String()] = c
 		}
+		s.m.Unlock()
+
+		// put fragmented messages back together
+		b, err := s.fragments.Add(addr.String(), buf[:n])
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if b == nil {
+			continue
+		}
 
 		// process message
 		s.wg.Add(1)
-		go s.serve(buf[:n], c)
+		go s.serve(b, c, addr)
 	}
 }
 
@@ -99,17 +317,34 @@ func (s *Server) CreateConn(addr net.Addr) (shared.Conn, error) {
 	}
 
 	c := shared.NewUDPConn(s.send, udpAddr)
+	s.m.Lock()
 	s.conns[addr.String()] = c
+	s.m.Unlock()
 	return c, nil
 }
 
-func (s *Server) OnMessage(f func(cs shared.Conns, c shared.Conn, m *shared.Message)) {
+// Conn returns the Conn at the address
+func (s *Server) Conn(addr string) (shared.Conn, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	c, ok := s.conns[addr]
+	return c, ok
+}
+
+func (s *Server) OnMessage(f func(c shared.Conn, m *shared.Message)) {
 	s.messageCallback = f
 }
 
+// OnMigrate is called after a session has moved from the address prev to the
+// address of its Conn
+func (s *Server) OnMigrate(f func(c shared.Conn, prev net.Addr)) {
+	s.migrateCallback = f
+}
+
 func (s *Server) Stop() {
 	close(s.exit)
 	s.wg.Wait()
+	s.c.Close()
 	log.Print("UDP server exited")
 }
 
@@ -129,9 +364,14 @@ func New(addr *net.UDPAddr) (*Server, error) {
 	return &Server{
 		c:               c,
 		conns:           make(shared.Conns),
+		sessions:        make(map[shared.SessionID]*shared.UDPConn),
+		paths:           make(map[string]*path),
+		fragments:       shared.NewReassembler(),
 		send:            make(chan *shared.UDPPayload, 100),
-		messageCallback: func(cs shared.Conns, c shared.Conn, m *shared.Message) {},
+		messageCallback: func(c shared.Conn, m *shared.Message) {},
+		migrateCallback: func(c shared.Conn, prev net.Addr) {},
 		exit:            make(chan bool),
 		wg:              &sync.WaitGroup{},
+		m:               &sync.Mutex{},
 	}, nil
 }